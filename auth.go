@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/erikdubbelboer/fasthttp"
+	"github.com/themester/fcookiejar"
+	"golang.org/x/net/context"
+)
+
+// authState is an authenticated session
+type authState struct {
+	client *fasthttp.Client
+	// cookies must be used with mu locked
+	mu      sync.Mutex
+	cookies *cookiejar.CookieJar
+	// login generation
+	gen uint64
+}
+
+// uaclient is an authenticated UACloud client shared by all goroutines.
+//
+// When UACloud says the session has expired, Do logs in again (once for
+// all goroutines waiting) and replays the request with the new session.
+type uaclient struct {
+	// serializes logins
+	mu    sync.Mutex
+	state atomic.Value // *authState
+	user  string
+	pass  *secret
+}
+
+func newUAClient(user string, pass *secret, client *fasthttp.Client, cookies *cookiejar.CookieJar) *uaclient {
+	c := &uaclient{
+		user: user,
+		pass: pass,
+	}
+	c.state.Store(&authState{
+		client:  client,
+		cookies: cookies,
+	})
+	return c
+}
+
+func (c *uaclient) current() *authState {
+	return c.state.Load().(*authState)
+}
+
+// Do performs req following redirects and handling session expiration.
+func (c *uaclient) Do(ctx context.Context, req *fasthttp.Request, res *fasthttp.Response) error {
+	orig := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(orig)
+	// redirects modify req
+	req.CopyTo(orig)
+	skip := res.SkipBody
+
+	st := c.current()
+	err := c.do(ctx, st, req, res)
+	if !errors.Is(err, errExpired) {
+		return err
+	}
+	log.Println("session expired. Logging in again")
+	err = c.relogin(ctx, st.gen)
+	if err != nil {
+		return err
+	}
+	orig.CopyTo(req)
+	res.Reset()
+	res.SkipBody = skip
+	return c.do(ctx, c.current(), req, res)
+}
+
+// do performs req using st session.
+//
+// The cookie jar of st is copied so it is not modified
+// by many goroutines at the same time.
+func (c *uaclient) do(ctx context.Context, st *authState, req *fasthttp.Request, res *fasthttp.Response) error {
+	cookies := cookiejar.AcquireCookieJar()
+	defer cookiejar.ReleaseCookieJar(cookies)
+	st.mu.Lock()
+	copyCookies(cookies, st.cookies)
+	st.mu.Unlock()
+
+	err := doReqFollowRedirects(ctx, req, res, st.client, cookies)
+	if errors.Is(err, errAuthFailed) {
+		// 401: our cookies are not valid anymore.
+		// 403 is not about the session (see kindForbidden)
+		return &uaError{kind: kindExpired, status: res.Header.StatusCode()}
+	}
+	if err != nil {
+		return err
+	}
+	if expired(req, res) {
+		return errExpired
+	}
+
+	st.mu.Lock()
+	copyCookies(st.cookies, cookies)
+	st.mu.Unlock()
+	return nil
+}
+
+// relogin logs in again unless it has been done
+// by other goroutine since generation gen.
+func (c *uaclient) relogin(ctx context.Context, gen uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current().gen != gen {
+		return nil
+	}
+	if c.pass.Empty() {
+		// resumed sessions have no password
+		pass, err := storedSecret(c.user)
+		if err != nil {
+			return &uaError{kind: kindExpired, err: err}
+		}
+		if pass.Empty() {
+			return &uaError{
+				kind: kindExpired,
+				err:  errors.New("no password to log in again (see -pass-cmd and -keyring)"),
+			}
+		}
+		c.pass = pass
+	}
+	client, cookies, err := login(ctx, c.user, c.pass)
+	if err != nil {
+		return err
+	}
+	c.state.Store(&authState{
+		client:  client,
+		cookies: cookies,
+		gen:     gen + 1,
+	})
+	return nil
+}
+
+// wipe wipes the password once no more logins are needed
+func (c *uaclient) wipe() {
+	c.mu.Lock()
+	c.pass.Wipe()
+	c.mu.Unlock()
+}
+
+// Cookies returns a copy of session cookies
+func (c *uaclient) Cookies() *cookiejar.CookieJar {
+	st := c.current()
+	cookies := cookiejar.AcquireCookieJar()
+	st.mu.Lock()
+	copyCookies(cookies, st.cookies)
+	st.mu.Unlock()
+	return cookies
+}
+
+// expired reports whether UACloud sent us to the CAS login
+// instead of answering req.
+func expired(req *fasthttp.Request, res *fasthttp.Response) bool {
+	if endpoints.isCAS(string(req.URI().Host()), string(req.URI().Path())) {
+		// redirected to autentica
+		return true
+	}
+	if !bytes.HasPrefix(res.Header.ContentType(), []byte("text/html")) {
+		return false
+	}
+	// login form in a 200 response
+	return regexep.Match(res.Body())
+}
+
+// copyCookies copies cookies of src into dst
+func copyCookies(dst, src *cookiejar.CookieJar) {
+	for k, c := range *src {
+		// CookieJar.Put keeps the key of the released cookie
+		if old, ok := (*dst)[k]; ok {
+			old.CopyTo(c)
+			continue
+		}
+		cc := fasthttp.AcquireCookie()
+		cc.CopyTo(c)
+		(*dst)[string(cc.Key())] = cc
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/LibreLABUA/uafs/fakeua"
+	"golang.org/x/net/context"
+)
+
+// subject returns the subject folder with code
+func subject(t *testing.T, items []*uaitem, code string) *uaitem {
+	t.Helper()
+	for _, it := range items {
+		if it.codasig == code {
+			return it
+		}
+	}
+	t.Fatalf("subject %s not found", code)
+	return nil
+}
+
+// TestExpiredViaCAS checks a POST sent back by CAS single sign-on
+// as a GET (a 404 here) is replayed after logging in again.
+func TestExpiredViaCAS(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	ctx := context.Background()
+	subjects, err := root.getFolders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := subject(t, subjects, "34012")
+
+	srv.ExpireSessions()
+	logins := srv.Requests(fakeua.CASPath + "/login")
+	items, err := root.getFolder(ctx, sub, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Errorf("got %d items, want 2", len(items))
+	}
+	if srv.Requests(fakeua.CASPath+"/login") <= logins {
+		t.Error("not logged in again")
+	}
+}
+
+// TestReloginResumed checks resumed sessions (without password)
+// get it from -pass-cmd to log in again.
+func TestReloginResumed(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	testFS(t)
+	// resuming the saved session
+	ua, pass, err := connect(testUser, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pass.Empty() {
+		t.Fatal("session not resumed")
+	}
+	root := newFS(ua, nil)
+	ctx := context.Background()
+
+	srv.Expire()
+	_, err = root.getFolders(ctx)
+	if !errors.Is(err, errExpired) {
+		t.Fatalf("got %v without password, want %v", err, errExpired)
+	}
+
+	old := *passCmd
+	defer func() { *passCmd = old }()
+	*passCmd = "echo " + testPass
+	_, err = root.getFolders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestForbidden checks 403 responses are not taken as expired sessions
+func TestForbidden(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	ctx := context.Background()
+	subjects, err := root.getFolders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := subject(t, subjects, "34012")
+
+	logins := srv.Requests(fakeua.CASPath + "/login")
+	srv.Fail(fakeua.FilesPath, 403)
+	_, err = root.getFolder(ctx, sub, sub)
+	if !errors.Is(err, errForbidden) {
+		t.Fatalf("got %v, want %v", err, errForbidden)
+	}
+	if toErrno(err) != fuse.Errno(syscall.EACCES) {
+		t.Errorf("got errno %v, want EACCES", toErrno(err))
+	}
+	if srv.Requests(fakeua.CASPath+"/login") != logins {
+		t.Error("logged in again")
+	}
+}
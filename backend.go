@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// backend holds the endpoints of a UACloud deployment.
+//
+// It can be loaded from the "backend" object of the config file
+// (see loadConfig) so uafs can be pointed at preproduction,
+// a local mirror or a test server.
+type backend struct {
+	// CAS server base URL (without /login)
+	CAS string `json:"cas"`
+	// CAS service the login is requested for
+	Service string `json:"service"`
+	// materials home. Used to check the session
+	Home string `json:"home"`
+	// subjects list
+	Folders string `json:"folders"`
+	// materials of a folder
+	Files string `json:"files"`
+	// material contents
+	Download string `json:"download"`
+}
+
+// defaultBackend is UACloud at the University of Alicante
+var defaultBackend = backend{
+	CAS:      `https://autentica.cpd.ua.es/cas`,
+	Service:  `https://cvnet.cpd.ua.es/uaMatDocente/Materiales/MaterialesAlumno`,
+	Home:     `https://cvnet.cpd.ua.es/uaMatDocente/Materiales/MaterialesAlumno`,
+	Folders:  `https://cvnet.cpd.ua.es/uamatdocente/Materiales/CursoMaterialesTodos`,
+	Files:    `https://cvnet.cpd.ua.es/uamatdocente/Materiales/VistaMateriales`,
+	Download: `https://cvnet.cpd.ua.es/uamatdocente/Materiales/DescargarArchivoAlu`,
+}
+
+// endpoints is the backend in use
+var endpoints = defaultBackend
+
+// loginURL returns the CAS login URL of the service
+func (b *backend) loginURL() string {
+	return strings.TrimSuffix(b.CAS, "/") + "/login?service=" + url.QueryEscape(b.Service)
+}
+
+// isCAS reports whether host and path belong to the CAS server
+func (b *backend) isCAS(host, path string) bool {
+	u, err := url.Parse(b.CAS)
+	if err != nil {
+		return false
+	}
+	return host == u.Host && strings.HasPrefix(path, u.Path)
+}
+
+// rebase replaces scheme and host of UACloud endpoints
+// with the ones of base (ex: http://localhost:8080).
+// CAS endpoints are not changed.
+func (b *backend) rebase(base string) error {
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	for _, s := range []*string{&b.Service, &b.Home, &b.Folders, &b.Files, &b.Download} {
+		e, err := url.Parse(*s)
+		if err != nil {
+			return err
+		}
+		e.Scheme, e.Host = u.Scheme, u.Host
+		*s = e.String()
+	}
+	return nil
+}
+
+// config is the content of the config file
+type config struct {
+	Backend *backend `json:"backend"`
+	// cache budget in MB. -s takes precedence
+	CacheSize *int64 `json:"cache_size"`
+}
+
+// configFile returns the path of the config file
+func configFile() string {
+	if *configPath != "" {
+		return *configPath
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(dir, "uafs", "config.json")
+}
+
+// flagSet reports whether the flag name was given
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// loadConfig sets endpoints and the cache budget using the config
+// file and flags. Missing values keep their default.
+func loadConfig() error {
+	if file := configFile(); file != "" {
+		data, err := ioutil.ReadFile(file)
+		switch {
+		case err == nil:
+			c := config{Backend: &endpoints}
+			err = json.Unmarshal(data, &c)
+			if err != nil {
+				return err
+			}
+			if c.CacheSize != nil && !flagSet("s") {
+				*cacheSize = *c.CacheSize
+			}
+		case *configPath != "" || !os.IsNotExist(err):
+			// the default config file is optional
+			return err
+		}
+	}
+	if *uacloudURL != "" {
+		err := endpoints.rebase(*uacloudURL)
+		if err != nil {
+			return err
+		}
+	}
+	if *casURL != "" {
+		endpoints.CAS = *casURL
+	}
+	if *serviceURL != "" {
+		endpoints.Service = *serviceURL
+	}
+	return nil
+}
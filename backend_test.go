@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigCacheSize(t *testing.T) {
+	defer func(size int64, file string, b backend) {
+		*cacheSize, *configPath, endpoints = size, file, b
+	}(*cacheSize, *configPath, endpoints)
+	*configPath = filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(*configPath, []byte(`{"cache_size": 2048}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if *cacheSize != 2048 {
+		t.Errorf("cache budget %d, want the one of the config file", *cacheSize)
+	}
+
+	// -s takes precedence
+	defer func(set *flag.FlagSet) { flag.CommandLine = set }(flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet("uafs", flag.ContinueOnError)
+	flag.Int64Var(cacheSize, "s", 1024, "")
+	if err := flag.CommandLine.Parse([]string{"-s", "100"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if *cacheSize != 100 {
+		t.Errorf("cache budget %d, want the one of -s", *cacheSize)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const manifestName = "manifest.json"
+
+// cacheEntry is the manifest record of a downloaded material
+type cacheEntry struct {
+	Key     string    `json:"key"`
+	ETag    string    `json:"etag,omitempty"`
+	Size    int64     `json:"size"`
+	Fetched time.Time `json:"fetched"`
+	Used    time.Time `json:"used"`
+	// open handles using the entry
+	pins int
+	// removed while pinned. Dropped by the last unpin
+	stale bool
+	elem  *list.Element
+}
+
+// cacheStats are counters used for debugging
+type cacheStats struct {
+	Hits         uint64
+	Misses       uint64
+	Evictions    uint64
+	EvictedBytes int64
+	Size         int64
+	Max          int64
+	Files        int
+	Pinned       int
+}
+
+func (s cacheStats) String() string {
+	return fmt.Sprintf(
+		"cache: %d files, %d/%d bytes, %d pinned, %d hits, %d misses, %d evictions (%d bytes)",
+		s.Files, s.Size, s.Max, s.Pinned, s.Hits, s.Misses, s.Evictions, s.EvictedBytes,
+	)
+}
+
+// diskCache stores downloaded materials on disk
+// keyed by subject code and material id (see uaitem.key)
+// so they survive remounts and renames.
+//
+// Entries are evicted in least recently used order
+// when the cache exceeds its byte budget.
+type diskCache struct {
+	sync.Mutex
+	dir string
+	// byte budget. 0 means unlimited
+	max  int64
+	size int64
+	// disk is where downloads are written
+	disk afero.Fs
+	// layer keeps local modifications out of disk
+	layer afero.Fs
+	// Fs is used to serve cached files
+	Fs      afero.Fs
+	entries map[string]*cacheEntry
+	// most recently used entries first
+	lru   *list.List
+	stats cacheStats
+}
+
+// openCache opens (or creates) cache directory dir
+// loading its manifest.
+func openCache(dir string, max int64) (*diskCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	disk := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	layer := afero.NewMemMapFs()
+	c := &diskCache{
+		dir:     dir,
+		max:     max,
+		disk:    disk,
+		layer:   layer,
+		Fs:      afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(disk), layer),
+		entries: make(map[string]*cacheEntry),
+		lru:     list.New(),
+	}
+
+	var entries []*cacheEntry
+	data, err := afero.ReadFile(disk, manifestName)
+	if err == nil {
+		// a corrupted manifest just means an empty cache
+		json.Unmarshal(data, &entries)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Used.After(entries[j].Used)
+	})
+	for _, e := range entries {
+		// ignoring entries which file has been removed
+		st, err := disk.Stat(e.Key)
+		if err != nil || st.Size() != e.Size {
+			continue
+		}
+		e.elem = c.lru.PushBack(e)
+		c.entries[e.Key] = e
+		c.size += e.Size
+	}
+	c.Lock()
+	c.shrink("")
+	c.Unlock()
+	return c, nil
+}
+
+// get returns manifest entry of key or nil
+func (c *diskCache) get(key string) *cacheEntry {
+	c.Lock()
+	e := c.entries[key]
+	if e != nil && e.stale {
+		e = nil
+	}
+	c.Unlock()
+	return e
+}
+
+// touch marks key as recently used.
+// It reports whether key is cached.
+func (c *diskCache) touch(key string) bool {
+	c.Lock()
+	ok := c.use(key)
+	c.Unlock()
+	return ok
+}
+
+// hit is like touch but records a cache hit or miss.
+func (c *diskCache) hit(key string) bool {
+	c.Lock()
+	ok := c.use(key)
+	if ok {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+	c.Unlock()
+	return ok
+}
+
+// use moves key to the front of the lru list. c must be locked
+func (c *diskCache) use(key string) bool {
+	e, ok := c.entries[key]
+	ok = ok && !e.stale
+	if ok {
+		e.Used = time.Now()
+		c.lru.MoveToFront(e.elem)
+	}
+	return ok
+}
+
+// pin prevents key from being evicted until unpin is called.
+// It reports whether key is cached.
+func (c *diskCache) pin(key string) bool {
+	c.Lock()
+	e, ok := c.entries[key]
+	ok = ok && !e.stale
+	if ok {
+		e.pins++
+	}
+	c.Unlock()
+	return ok
+}
+
+// unpin releases a pin acquired with pin
+// dropping the entry if it was removed while pinned
+func (c *diskCache) unpin(key string) {
+	c.Lock()
+	if e, ok := c.entries[key]; ok && e.pins > 0 {
+		e.pins--
+		if e.pins == 0 && e.stale {
+			c.drop(e)
+			c.save()
+		}
+		c.shrink("")
+	}
+	c.Unlock()
+}
+
+// create returns a temporary file to write key contents.
+// The file must be committed using store.
+func (c *diskCache) create(key string) (afero.File, error) {
+	err := c.disk.MkdirAll(path.Dir(key), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return c.disk.OpenFile(key+".part", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+}
+
+// reopen opens a file created with create to go on writing it
+func (c *diskCache) reopen(key string) (afero.File, error) {
+	return c.disk.OpenFile(key+".part", os.O_RDWR, 0600)
+}
+
+// store commits a file created with create to the cache.
+//
+// It replaces the current contents even if they are pinned:
+// handles keep reading the file they opened.
+func (c *diskCache) store(key, etag string) error {
+	c.Lock()
+	defer c.Unlock()
+	err := c.disk.Rename(key+".part", key)
+	if err != nil {
+		return err
+	}
+	st, err := c.disk.Stat(key)
+	if err != nil {
+		return err
+	}
+	// modified copies are outdated now
+	c.layer.Remove(key)
+
+	now := time.Now()
+	e, ok := c.entries[key]
+	if ok {
+		c.size -= e.Size
+		c.lru.MoveToFront(e.elem)
+	} else {
+		e = &cacheEntry{Key: key}
+		e.elem = c.lru.PushFront(e)
+		c.entries[key] = e
+	}
+	e.stale = false
+	e.ETag = etag
+	e.Size = st.Size()
+	e.Fetched = now
+	e.Used = now
+	c.size += e.Size
+	c.shrink(key)
+	return c.save()
+}
+
+// remove deletes key from the cache. Pinned entries are
+// marked stale instead: new handles do not use them and
+// they are dropped by the last unpin.
+func (c *diskCache) remove(key string) {
+	c.Lock()
+	if e, ok := c.entries[key]; ok {
+		if e.pins > 0 {
+			e.stale = true
+		} else {
+			c.drop(e)
+		}
+		c.save()
+	}
+	c.Unlock()
+}
+
+// drop deletes e. c must be locked
+func (c *diskCache) drop(e *cacheEntry) {
+	delete(c.entries, e.Key)
+	c.lru.Remove(e.elem)
+	c.size -= e.Size
+	c.disk.Remove(e.Key)
+	c.layer.Remove(e.Key)
+}
+
+// shrink evicts least recently used entries until the cache
+// fits its byte budget. Pinned entries and keep are never evicted.
+// c must be locked
+func (c *diskCache) shrink(keep string) {
+	evicted := false
+	el := c.lru.Back()
+	for c.max > 0 && c.size > c.max && el != nil {
+		e := el.Value.(*cacheEntry)
+		el = el.Prev()
+		if e.pins > 0 || e.Key == keep {
+			continue
+		}
+		c.drop(e)
+		c.stats.Evictions++
+		c.stats.EvictedBytes += e.Size
+		evicted = true
+	}
+	if evicted {
+		c.save()
+	}
+}
+
+// Stats returns cache counters
+func (c *diskCache) Stats() cacheStats {
+	c.Lock()
+	s := c.stats
+	s.Size = c.size
+	s.Max = c.max
+	s.Files = len(c.entries)
+	for _, e := range c.entries {
+		if e.pins > 0 {
+			s.Pinned++
+		}
+	}
+	c.Unlock()
+	return s
+}
+
+// save writes the manifest. c must be locked
+func (c *diskCache) save() error {
+	entries := make([]*cacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		if !e.stale {
+			entries = append(entries, e)
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	err = afero.WriteFile(c.disk, manifestName+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return c.disk.Rename(manifestName+".tmp", manifestName)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// put stores contents as key like a finished download
+func put(t *testing.T, c *diskCache, key, contents string) {
+	t.Helper()
+	f, err := c.create(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(contents)
+	f.Close()
+	if err := c.store(key, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// contents returns what a new handle of key reads
+func contents(t *testing.T, c *diskCache, key string) string {
+	t.Helper()
+	b, err := afero.ReadFile(c.Fs, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCacheRemovePinned(t *testing.T) {
+	dir := t.TempDir()
+	c, err := openCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "34012/1001"
+	put(t, c, key, "old")
+	if !c.pin(key) {
+		t.Fatal("not cached")
+	}
+	f, err := c.Fs.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// changed in UACloud (see FS.merge)
+	c.remove(key)
+	if c.hit(key) || c.get(key) != nil || c.pin(key) {
+		t.Error("stale entry used")
+	}
+	if b, _ := ioutil.ReadAll(f); string(b) != "old" {
+		t.Errorf("open handle read %q", b)
+	}
+	// not reused after a remount
+	c2, err := openCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.get(key) != nil {
+		t.Error("stale entry saved in the manifest")
+	}
+
+	c.unpin(key)
+	if _, ok := c.entries[key]; ok {
+		t.Error("stale entry not dropped by unpin")
+	}
+	if _, err := c.disk.Stat(key); err == nil {
+		t.Error("stale file not removed")
+	}
+}
+
+func TestCacheStorePinned(t *testing.T) {
+	c, err := openCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "34012/1001"
+	put(t, c, key, "old")
+	c.pin(key)
+	f, err := c.Fs.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c.remove(key)
+
+	// downloaded again while the old contents are read
+	put(t, c, key, "new contents")
+	if !c.hit(key) {
+		t.Fatal("new download not cached")
+	}
+	if got := contents(t, c, key); got != "new contents" {
+		t.Errorf("new handle read %q", got)
+	}
+	if b, _ := ioutil.ReadAll(f); string(b) != "old" {
+		t.Errorf("open handle read %q", b)
+	}
+	// the pin of the old handle does not drop the new download
+	c.unpin(key)
+	if !c.hit(key) {
+		t.Error("new download dropped by unpin")
+	}
+	if s := c.Stats(); s.Size != int64(len("new contents")) || s.Pinned != 0 {
+		t.Errorf("bad stats: %s", s)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	// stay attached logging to stderr (systemd, debugging)
+	foreground = flag.Bool("foreground", false, "Do not daemonize and log to stderr")
+	logFile    = flag.String("log-file", "", "Log file (default stderr in foreground, $TMPDIR/uafs.log otherwise)")
+	verbose    = flag.Bool("verbose", false, "Log every UACloud request")
+)
+
+func init() {
+	// short aliases
+	flag.BoolVar(foreground, "f", false, "Same as -foreground")
+	flag.BoolVar(verbose, "v", false, "Same as -verbose")
+	flag.Usage = usage
+}
+
+// parseArgs parses flags of args returning positional arguments.
+// Unlike flag.Parse, flags can be placed after positional arguments.
+// Arguments after "--" are never flags.
+func parseArgs(set *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for len(args) > 0 {
+		err := set.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		rest := set.Args()
+		// Parse stops at the first positional argument or after "--"
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(pos, rest...), nil
+		}
+		if len(rest) == 0 {
+			break
+		}
+		pos = append(pos, rest[0])
+		args = rest[1:]
+	}
+	return pos, nil
+}
+
+// setupLog sends log output to -log-file or to def
+func setupLog(def string) error {
+	file := *logFile
+	if file == "" {
+		file = def
+	}
+	if file == "" {
+		return nil
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	return nil
+}
+
+// defaultLogFile is the log of the daemon
+func defaultLogFile() string {
+	return path.Join(os.TempDir(), "uafs.log")
+}
+
+// debugf logs when -verbose is set
+func debugf(format string, args ...interface{}) {
+	if *verbose {
+		log.Printf(format, args...)
+	}
+}
+
+// username completes user with the students domain
+func username(user string) string {
+	if !strings.Contains(user, "@alu") {
+		user += "@alu.ua.es"
+	}
+	return user
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		cmd  string
+		pos  []string
+		// flags set
+		fg, del, long bool
+		// wrong number of arguments
+		usage bool
+		err   bool
+	}{
+		{args: []string{"user", "/mnt"}, cmd: "mount", pos: []string{"user", "/mnt"}},
+		{args: []string{"-f", "user", "/mnt"}, cmd: "mount", pos: []string{"user", "/mnt"}, fg: true},
+		{args: []string{"user", "/mnt", "--foreground"}, cmd: "mount", pos: []string{"user", "/mnt"}, fg: true},
+		{args: []string{"user", "-foreground=true", "/mnt"}, cmd: "mount", pos: []string{"user", "/mnt"}, fg: true},
+		{args: []string{"user"}, cmd: "mount", pos: []string{"user"}, usage: true},
+		// commands are only taken from the first argument
+		{args: []string{"-f", "ls", "user"}, cmd: "mount", pos: []string{"ls", "user"}, fg: true},
+		{args: []string{"user", "ls"}, cmd: "mount", pos: []string{"user", "ls"}},
+		{args: []string{"sync", "user", "-delete", "dir"}, cmd: "sync", pos: []string{"user", "dir"}, del: true},
+		{args: []string{"sync", "user", "dir", "extra"}, cmd: "sync", pos: []string{"user", "dir", "extra"}, usage: true},
+		{args: []string{"ls", "-l", "user", "Cálculo", "-f"}, cmd: "ls", pos: []string{"user", "Cálculo"}, long: true, fg: true},
+		// no flags after --
+		{args: []string{"ls", "user", "--", "-f"}, cmd: "ls", pos: []string{"user", "-f"}},
+		{args: []string{"get", "user", "-l", "--", "-x", "--"}, cmd: "get", pos: []string{"user", "-x", "--"}, long: true},
+		{args: []string{"unmount"}, cmd: "unmount", usage: true},
+		{args: []string{"tree", "user", "-x"}, err: true},
+	} {
+		set := flag.NewFlagSet("uafs", flag.ContinueOnError)
+		set.SetOutput(ioutil.Discard)
+		var fg, del, long bool
+		set.BoolVar(&fg, "foreground", false, "")
+		set.BoolVar(&fg, "f", false, "")
+		set.BoolVar(&del, "delete", false, "")
+		set.BoolVar(&long, "l", false, "")
+
+		cmd, pos, err := parseCommand(set, tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.args, err)
+			continue
+		}
+		if cmd.name != tt.cmd || !reflect.DeepEqual(pos, tt.pos) {
+			t.Errorf("%q: got %s %q, want %s %q", tt.args, cmd.name, pos, tt.cmd, tt.pos)
+		}
+		if fg != tt.fg || del != tt.del || long != tt.long {
+			t.Errorf("%q: got flags %v %v %v, want %v %v %v", tt.args, fg, del, long, tt.fg, tt.del, tt.long)
+		}
+		if cmd.takes(len(pos)) == tt.usage {
+			t.Errorf("%q: %d arguments taken %v", tt.args, len(pos), !tt.usage)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/LibreLABUA/uafs/fakeua"
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+// bigSubject returns a subject with a material of many chunks
+func bigSubject() *fakeua.Subject {
+	content := make([]byte, 2*chunkSize+1234)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	return &fakeua.Subject{
+		Code: "34020",
+		Name: "Redes",
+		Items: []*fakeua.Item{
+			{ID: "3001", Name: "video.mp4", Content: content},
+		},
+	}
+}
+
+// fetched returns the item at p fetching the whole tree
+func fetched(t *testing.T, root *FS, p string) *uaitem {
+	t.Helper()
+	if err := root.fetch(); err != nil {
+		t.Fatal(err)
+	}
+	it, err := root.find(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return it
+}
+
+// downloaded downloads it returning the cached contents
+func downloaded(t *testing.T, root *FS, it *uaitem) []byte {
+	t.Helper()
+	if err := root.download(context.Background(), it); err != nil {
+		t.Fatal(err)
+	}
+	b, err := afero.ReadFile(root.cache.Fs, it.key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLogin(t *testing.T) {
+	startFake(t, testSubjects()...)
+	ctx := context.Background()
+
+	_, _, err := login(ctx, testUser, newSecret([]byte("incorrecto")))
+	if !errors.Is(err, errAuthFailed) {
+		t.Errorf("bad password: got %v, want %v", err, errAuthFailed)
+	}
+	_, _, err = login(ctx, "nadie@alu.ua.es", newSecret([]byte(testPass)))
+	if !errors.Is(err, errAuthFailed) {
+		t.Errorf("bad user: got %v, want %v", err, errAuthFailed)
+	}
+
+	client, cookies, err := login(ctx, testUser, newSecret([]byte(testPass)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := newFS(newUAClient(testUser, nil, client, cookies), nil)
+	subjects, err := root.getFolders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subjects) != 2 {
+		t.Errorf("got %d subjects, want 2", len(subjects))
+	}
+	// the session is saved
+	if _, _, err := resume(ctx, testUser); err != nil {
+		t.Error("session not resumed:", err)
+	}
+}
+
+func TestExpireReplay(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	ctx := context.Background()
+	if _, err := root.getFolders(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Expire()
+	logins := srv.Requests(fakeua.CASPath + "/login")
+	subjects, err := root.getFolders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subjects) != 2 {
+		t.Errorf("got %d subjects, want 2", len(subjects))
+	}
+	if srv.Requests(fakeua.CASPath+"/login") <= logins {
+		t.Error("CAS login not used")
+	}
+	if root.ua.current().gen != 1 {
+		t.Error("not logged in again")
+	}
+}
+
+func TestDownloadRanges(t *testing.T) {
+	sub := bigSubject()
+	want := sub.Items[0].Content
+	for _, noRanges := range []bool{false, true} {
+		srv := startFake(t, sub)
+		srv.NoRanges = noRanges
+		root := testFS(t)
+		it := fetched(t, root, "/Redes/video.mp4")
+
+		got := downloaded(t, root, it)
+		if !bytes.Equal(got, want) {
+			t.Errorf("NoRanges %v: got %d bytes, want %d", noRanges, len(got), len(want))
+		}
+		requests := 3
+		if noRanges {
+			// the whole file is sent at once
+			requests = 1
+		}
+		if n := srv.Requests(fakeua.DownloadPath); n != requests {
+			t.Errorf("NoRanges %v: got %d requests, want %d", noRanges, n, requests)
+		}
+	}
+}
+
+func TestDownloadEmpty(t *testing.T) {
+	for _, noRanges := range []bool{false, true} {
+		srv := startFake(t, &fakeua.Subject{
+			Code:  "34021",
+			Name:  "Vacía",
+			Items: []*fakeua.Item{{ID: "4001", Name: "vacío.txt"}},
+		})
+		// 416 or an empty body
+		srv.NoRanges = noRanges
+		root := testFS(t)
+		it := fetched(t, root, "/Vacía/vacío.txt")
+
+		if got := downloaded(t, root, it); len(got) != 0 {
+			t.Errorf("NoRanges %v: got %q", noRanges, got)
+		}
+		if n := srv.Requests(fakeua.DownloadPath); n != 1 {
+			t.Errorf("NoRanges %v: got %d requests, want 1", noRanges, n)
+		}
+	}
+}
+
+func TestDownloadChanged(t *testing.T) {
+	sub := bigSubject()
+	old := sub.Items[0].Content
+	want := old[:chunkSize+10]
+	sub.Items[0].Content = want
+	startFake(t, sub)
+	root := testFS(t)
+	it := fetched(t, root, "/Redes/video.mp4")
+
+	// interrupted download of a longer version
+	key := it.key()
+	f, err := root.cache.create(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(old)
+	f.Close()
+	root.partials[key] = &partial{
+		size: int64(len(old)),
+		etag: `"old"`,
+		have: []bool{true, false, true},
+	}
+
+	if got := downloaded(t, root, it); !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestRetries(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	ctx := context.Background()
+
+	srv.Fail(fakeua.FoldersPath, 503, 503)
+	before := srv.Requests(fakeua.FoldersPath)
+	if _, err := root.getFolders(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Requests(fakeua.FoldersPath) - before; n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+
+	// giving up after maxRetries
+	srv.Fail(fakeua.FoldersPath, 503, 503, 503, 503)
+	before = srv.Requests(fakeua.FoldersPath)
+	_, err := root.getFolders(ctx)
+	if !errors.Is(err, errServer) {
+		t.Errorf("got %v, want %v", err, errServer)
+	}
+	if n := srv.Requests(fakeua.FoldersPath) - before; n != maxRetries {
+		t.Errorf("got %d requests, want %d", n, maxRetries)
+	}
+}
+
+func TestProbeLimited(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	it := fetched(t, root, "/Cálculo/apuntes.txt")
+
+	root.limit = newRateLimiter(100)
+	if size := root.sizeOf(context.Background(), it); size != int64(len("derivadas")) {
+		t.Errorf("probed size %d", size)
+	}
+	if _, ok := root.limit.next["uacloud.test"]; !ok {
+		t.Error("probe not rate limited")
+	}
+	// probed once
+	root.sizeOf(context.Background(), it)
+	if n := srv.Requests(fakeua.DownloadPath); n != 1 {
+		t.Errorf("%d probes, want 1", n)
+	}
+}
+
+// TestDownloadAborted checks a canceled read stops its download
+// at once, and the next read resumes it.
+func TestDownloadAborted(t *testing.T) {
+	sub := bigSubject()
+	want := sub.Items[0].Content
+	srv := startFake(t, sub)
+	root := testFS(t)
+	it := fetched(t, root, "/Redes/video.mp4")
+
+	// the second chunk never comes
+	release := srv.Stall(fakeua.DownloadPath, 2)
+	defer release()
+	tr, err := root.stream(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 100)
+	if _, err := tr.read(context.Background(), p, 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for srv.Requests(fakeua.DownloadPath) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	if _, err := tr.read(ctx, p, chunkSize); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	tr.release()
+	// not waiting for -timeout
+	wctx, wcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer wcancel()
+	if err := tr.wait(wctx); err != context.Canceled {
+		t.Fatalf("transfer: got %v, want %v", err, context.Canceled)
+	}
+
+	root.Lock()
+	pt := root.partials[it.key()]
+	root.Unlock()
+	if pt == nil || !reflect.DeepEqual(pt.have, []bool{true, false, false}) {
+		t.Fatalf("got partial %+v, want the first chunk", pt)
+	}
+	b, err := afero.ReadFile(root.cache.disk, it.key()+".part")
+	if err != nil || !bytes.Equal(b[:chunkSize], want[:chunkSize]) {
+		t.Errorf("partial contents: %v", err)
+	}
+
+	release()
+	if got := downloaded(t, root, it); !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+	// the first chunk is not downloaded again
+	if n := srv.Requests(fakeua.DownloadPath); n != 4 {
+		t.Errorf("got %d requests, want 4", n)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// long listing of ls
+var longList = flag.Bool("l", false, "ls: show size, date and title of materials")
+
+// command is a uafs subcommand
+type command struct {
+	name string
+	args string
+	help string
+	// number of arguments
+	min, max int
+	run      func(args []string) error
+}
+
+// mountCmd is also run when no command is given
+var mountCmd = &command{
+	name: "mount", args: "<user> <mount point>",
+	help: "mount UACloud materials",
+	min:  2, max: 2,
+	run: runMount,
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		mountCmd,
+		{
+			name: "unmount", args: "<mount point>",
+			help: "unmount a mounted uafs",
+			min:  1, max: 1,
+			run: runUnmount,
+		},
+		{
+			name: "ls", args: "<user> [path]",
+			help: "list materials of a folder (see -l)",
+			min:  1, max: 2,
+			run: runLs,
+		},
+		{
+			name: "tree", args: "<user> [path]",
+			help: "print the tree of materials",
+			min:  1, max: 2,
+			run: runTree,
+		},
+		{
+			name: "get", args: "<user> <path> [file]",
+			help: "download a material to file or stdout",
+			min:  2, max: 3,
+			run: runGet,
+		},
+		{
+			name: "sync", args: "<user> <dir>",
+			help: "download new and changed materials to dir (see -delete)",
+			min:  2, max: 2,
+			run: runSync,
+		},
+		{
+			name: "status", args: "[user]",
+			help: "show running mounts",
+			min:  0, max: 1,
+			run: runStatus,
+		},
+		{
+			name: "login", args: "<user>",
+			help: "log in saving the session",
+			min:  1, max: 1,
+			run: runLogin,
+		},
+		{
+			name: "logout", args: "<user>",
+			help: "remove the saved session",
+			min:  1, max: 1,
+			run: runLogout,
+		},
+	}
+}
+
+// findCommand returns the command called name or nil
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// parseCommand returns the command named by the first of args
+// and its arguments. Without a command name args are mounted.
+func parseCommand(set *flag.FlagSet, args []string) (*command, []string, error) {
+	cmd := mountCmd
+	if len(args) > 0 {
+		if c := findCommand(args[0]); c != nil {
+			cmd, args = c, args[1:]
+		}
+	}
+	args, err := parseArgs(set, args)
+	return cmd, args, err
+}
+
+// takes reports whether c can be run with n arguments
+func (c *command) takes(n int) bool {
+	return n >= c.min && n <= c.max
+}
+
+func (c *command) usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s %s [flags] %s\n", os.Args[0], c.name, c.args)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags] <args>\n\ncommands:\n", os.Args[0])
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", c.name, c.args, c.help)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nWithout command, %s <user> <mount point> mounts.\n\nflags:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// interruptible returns a context canceled by SIGINT or SIGTERM
+func interruptible() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
+
+// openFS returns the filesystem of user without mounting it.
+// The password is kept to log in again if the session expires:
+// callers wipe it calling root.ua.wipe when they are done.
+//
+// If some subjects or rows cannot be fetched the filesystem
+// is returned with the error, so the rest can be used.
+func openFS(user string) (*FS, error) {
+	ua, _, err := connect(user, nil)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := openUserCache(user)
+	if err != nil {
+		ua.wipe()
+		return nil, err
+	}
+	root := newFS(ua, cache)
+	err = root.fetch()
+	var serr *subjectsError
+	if err != nil && !errors.As(err, &serr) && !errors.Is(err, errDecode) {
+		ua.wipe()
+		return nil, err
+	}
+	return root, err
+}
+
+// find returns the item at p (relative to the root) or nil for the root
+func (root *FS) find(p string) (*uaitem, error) {
+	p = path.Join("/", p)
+	if p == "/" {
+		return nil, nil
+	}
+	it := lookup(root.items, p)
+	if it == nil {
+		return nil, fmt.Errorf("%s: %s", p, errNotFound)
+	}
+	return it, nil
+}
+
+// children returns items inside it (the root if nil)
+func (root *FS) children(it *uaitem) []*uaitem {
+	if it == nil {
+		return root.items
+	}
+	if !it.folder {
+		return []*uaitem{it}
+	}
+	return it.items
+}
+
+func runUnmount(args []string) error {
+	return fuse.Unmount(args[0])
+}
+
+func runLs(args []string) error {
+	// an incomplete tree is listed failing at the end
+	root, ferr := openFS(username(args[0]))
+	if root == nil {
+		return ferr
+	}
+	defer root.ua.wipe()
+	p := ""
+	if len(args) > 1 {
+		p = args[1]
+	}
+	it, err := root.find(p)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	for _, c := range root.children(it) {
+		name := c.name
+		if c.folder {
+			name += "/"
+		}
+		if !*longList {
+			fmt.Fprintln(w, name)
+			continue
+		}
+		size, date := "-", "-"
+		if c.size > 0 {
+			size = fmt.Sprint(c.size)
+		}
+		if !c.date.IsZero() {
+			date = c.date.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", size, date, name, c.title)
+	}
+	return ferr
+}
+
+func runTree(args []string) error {
+	// an incomplete tree is listed failing at the end
+	root, ferr := openFS(username(args[0]))
+	if root == nil {
+		return ferr
+	}
+	defer root.ua.wipe()
+	p := ""
+	if len(args) > 1 {
+		p = args[1]
+	}
+	it, err := root.find(p)
+	if err != nil {
+		return err
+	}
+	if it == nil {
+		fmt.Println("/")
+	} else {
+		fmt.Println(it.fullpath())
+	}
+	printTree(os.Stdout, root.children(it), "")
+	return ferr
+}
+
+// printTree prints items using tree(1) format
+func printTree(w io.Writer, items []*uaitem, prefix string) {
+	for i, it := range items {
+		branch, next := "├── ", "│   "
+		if i == len(items)-1 {
+			branch, next = "└── ", "    "
+		}
+		name := it.name
+		if it.folder {
+			name += "/"
+		}
+		fmt.Fprintln(w, prefix+branch+name)
+		if it.folder {
+			printTree(w, it.items, prefix+next)
+		}
+	}
+}
+
+func runGet(args []string) error {
+	// materials of the subjects fetched can be downloaded
+	root, err := openFS(username(args[0]))
+	if root == nil {
+		return err
+	}
+	defer root.ua.wipe()
+	it, err := root.find(args[1])
+	if err != nil {
+		return err
+	}
+	if it == nil || it.folder {
+		return fmt.Errorf("%s is a folder", path.Join("/", args[1]))
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+	err = root.download(ctx, it)
+	if err != nil {
+		return err
+	}
+	src, err := root.cache.Fs.Open(it.key())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst := os.Stdout
+	if len(args) > 2 && args[2] != "-" {
+		file := args[2]
+		if st, err := os.Stat(file); err == nil && st.IsDir() {
+			file = path.Join(file, it.name)
+		}
+		dst, err = os.Create(file)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func runStatus(args []string) error {
+	var socks []string
+	if len(args) > 0 {
+		sock, err := controlSocket(username(args[0]))
+		if err != nil {
+			return err
+		}
+		socks = append(socks, sock)
+	} else {
+		var err error
+		socks, err = controlSockets()
+		if err != nil {
+			return err
+		}
+	}
+	if len(socks) == 0 {
+		fmt.Println("no uafs mounted")
+		return nil
+	}
+	for _, sock := range socks {
+		st, err := queryStatus(sock)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", strings.TrimSuffix(path.Base(sock), ".sock"), err)
+			continue
+		}
+		fmt.Print(st)
+	}
+	return nil
+}
+
+func runLogin(args []string) error {
+	user := username(args[0])
+	pass, err := getSecret(user)
+	if err != nil {
+		return err
+	}
+	defer pass.Wipe()
+	_, _, err = login(context.Background(), user, pass)
+	if err != nil {
+		return err
+	}
+	fmt.Println("logged in as", user)
+	return nil
+}
+
+func runLogout(args []string) error {
+	user := username(args[0])
+	err := removeSession(user)
+	if err != nil {
+		return err
+	}
+	fmt.Println("session of", user, "removed")
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// TestOpenFSFailedSubject checks one subject does not hide the rest
+func TestOpenFSFailedSubject(t *testing.T) {
+	subjects := testSubjects()
+	subjects[1].FailWith = 404
+	startFake(t, subjects...)
+	withPassword(t, "echo "+testPass)
+	old := *crawlRate
+	defer func() { *crawlRate = old }()
+	*crawlRate = 0
+
+	root, err := openFS(testUser)
+	if root == nil {
+		t.Fatal(err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "Cálculo") {
+		t.Errorf("got error %v, want the failed subject", err)
+	}
+	if it, _ := root.find("FUNDAMENTOS DE LOS COMPUTADORES/Prácticas/p1.txt"); it == nil {
+		t.Error("other subjects not fetched")
+	}
+}
+
+// TestOpenFSRelogin checks commands can log in again
+// when the session expires while they run.
+func TestOpenFSRelogin(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	// given once, like the terminal does
+	file := filepath.Join(t.TempDir(), "pass")
+	if err := ioutil.WriteFile(file, []byte(testPass), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withPassword(t, "cat "+file+" && rm "+file)
+
+	root, err := openFS(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Expire()
+	if _, err := root.getFolders(context.Background()); err != nil {
+		t.Errorf("not logged in again: %s", err)
+	}
+
+	root.ua.wipe()
+	srv.Expire()
+	if _, err := root.getFolders(context.Background()); !errors.Is(err, errExpired) {
+		t.Errorf("wiped password: got %v, want %v", err, errExpired)
+	}
+}
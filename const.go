@@ -1,10 +0,0 @@
-package main
-
-const (
-	urlNormal   = `https://autentica.cpd.ua.es/cas/login?service=https://cvnet.cpd.ua.es/uacloud/home/indexVerificado`
-	urlLogin    = `https://autentica.cpd.ua.es/cas/login?service=https://cvnet.cpd.ua.es/uaMatDocente/Materiales/MaterialesAlumno`
-	urlFuck     = `https://cvnet.cpd.ua.es/uaMatDocente/Materiales/MaterialesAlumno`
-	urlFolders  = `https://cvnet.cpd.ua.es/uamatdocente/Materiales/CursoMaterialesTodos`
-	urlFiles    = `https://cvnet.cpd.ua.es/uamatdocente/Materiales/VistaMateriales`
-	urlDownload = `https://cvnet.cpd.ua.es/uamatdocente/Materiales/DescargarArchivoAlu`
-)
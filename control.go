@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mountStatus is what a running mount tells through its control socket
+type mountStatus struct {
+	User       string     `json:"user"`
+	Mountpoint string     `json:"mountpoint"`
+	PID        int        `json:"pid"`
+	Started    time.Time  `json:"started"`
+	Fetched    time.Time  `json:"fetched"`
+	Subjects   int        `json:"subjects"`
+	Materials  int        `json:"materials"`
+	Downloads  int        `json:"downloads"`
+	Cache      cacheStats `json:"cache"`
+}
+
+func (st *mountStatus) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s on %s (pid %d, up %s)\n",
+		st.User, st.Mountpoint, st.PID, time.Since(st.Started).Round(time.Second))
+	fetched := "never"
+	if !st.Fetched.IsZero() {
+		fetched = st.Fetched.Format(time.RFC3339)
+	}
+	fmt.Fprintf(&b, "  %d subjects, %d materials, refreshed %s\n", st.Subjects, st.Materials, fetched)
+	fmt.Fprintf(&b, "  %d downloads in progress\n", st.Downloads)
+	fmt.Fprintf(&b, "  %s\n", st.Cache)
+	return b.String()
+}
+
+// controlDir returns the directory of control sockets
+func controlDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir, nil
+	}
+	return configDir()
+}
+
+// controlSocket returns the control socket of the mount of user
+func controlSocket(user string) (string, error) {
+	dir, err := controlDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, "uafs-"+user+".sock"), nil
+}
+
+// controlSockets returns the control sockets of all mounts
+func controlSockets() ([]string, error) {
+	dir, err := controlDir()
+	if err != nil {
+		return nil, err
+	}
+	return filepath.Glob(path.Join(dir, "uafs-*.sock"))
+}
+
+// status returns the status of the mount
+func (root *FS) status(mnt string, started time.Time) *mountStatus {
+	st := &mountStatus{
+		User:       root.Name,
+		Mountpoint: mnt,
+		PID:        os.Getpid(),
+		Started:    started,
+		Cache:      root.cache.Stats(),
+	}
+	root.RLock()
+	st.Fetched = root.fetched
+	st.Downloads = len(root.transfers)
+	st.Subjects = len(root.items)
+	var count func([]*uaitem)
+	count = func(items []*uaitem) {
+		for _, it := range items {
+			if !it.folder {
+				st.Materials++
+			}
+			count(it.items)
+		}
+	}
+	count(root.items)
+	root.RUnlock()
+	return st
+}
+
+// serveControl answers status requests on the control socket
+// of the mount until it is closed.
+func serveControl(root *FS, mnt string) (net.Listener, error) {
+	sock, err := controlSocket(root.Name)
+	if err != nil {
+		return nil, err
+	}
+	if c, err := net.Dial("unix", sock); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s is already mounted (see uafs status)", root.Name)
+	}
+	// left by a crashed mount
+	os.Remove(sock)
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(sock, 0600)
+
+	started := time.Now()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			// clients can go away (see the check above)
+			json.NewEncoder(c).Encode(root.status(mnt, started))
+			c.Close()
+		}
+	}()
+	return ln, nil
+}
+
+// queryStatus asks the mount listening on sock for its status
+func queryStatus(sock string) (*mountStatus, error) {
+	c, err := net.DialTimeout("unix", sock, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	var st mountStatus
+	err = json.NewDecoder(c).Decode(&st)
+	return &st, err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// folders fetched at the same time
+	crawlWorkers = flag.Int("workers", 4, "Folders fetched concurrently")
+	// UA servers throttle clients doing too many requests
+	crawlRate = flag.Float64("rate", 10, "Max folder and size requests per second to a host (0 means unlimited)")
+)
+
+// rateLimiter spaces requests to the same host
+type rateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	// when the next request to every host can be done
+	next map[string]time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	l := &rateLimiter{
+		next: make(map[string]time.Time),
+	}
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return l
+}
+
+// wait waits until a request to host can be done
+func (l *rateLimiter) wait(ctx context.Context, host []byte) error {
+	if l.interval == 0 {
+		return ctx.Err()
+	}
+	l.Lock()
+	now := time.Now()
+	at := l.next[string(host)]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[string(host)] = at.Add(l.interval)
+	l.Unlock()
+
+	select {
+	case <-time.After(at.Sub(now)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// crawler fetches folders of many subjects concurrently
+// using at most -workers requests at the same time.
+type crawler struct {
+	fs *FS
+	// a token is held while fetching a folder
+	tokens chan struct{}
+	wg     sync.WaitGroup
+}
+
+// subjectCrawl is the crawl of a subject.
+// The first error stops it without affecting other subjects.
+type subjectCrawl struct {
+	subject *uaitem
+	ctx     context.Context
+	cancel  context.CancelFunc
+	once    sync.Once
+	err     error
+}
+
+func (sc *subjectCrawl) fail(err error) {
+	sc.once.Do(func() {
+		sc.err = err
+		sc.cancel()
+	})
+}
+
+// getSubjects fetches items of subjects returning the error
+// of every subject. Subjects with errors can be incomplete.
+//
+// Items keep the order of UACloud listings
+// so the resulting tree does not depend on timing.
+func (fs *FS) getSubjects(ctx context.Context, subjects []*uaitem) []error {
+	workers := *crawlWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	c := &crawler{
+		fs:     fs,
+		tokens: make(chan struct{}, workers),
+	}
+	crawls := make([]*subjectCrawl, len(subjects))
+	for i, subject := range subjects {
+		sc := &subjectCrawl{subject: subject}
+		sc.ctx, sc.cancel = context.WithCancel(ctx)
+		crawls[i] = sc
+		c.folder(sc, subject)
+	}
+	c.wg.Wait()
+
+	errs := make([]error, len(subjects))
+	for i, sc := range crawls {
+		sc.cancel()
+		errs[i] = sc.err
+	}
+	return errs
+}
+
+// folder fetches dir and its subfolders in the background
+func (c *crawler) folder(sc *subjectCrawl, dir *uaitem) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		select {
+		case c.tokens <- struct{}{}:
+		case <-sc.ctx.Done():
+			return
+		}
+		items, err := c.fs.getFolder(sc.ctx, sc.subject, dir)
+		<-c.tokens
+		if err != nil {
+			// malformed listings are kept but the subject fails,
+			// so it inherits the current items (see usable)
+			sc.fail(err)
+			if !usable(items, err) {
+				return
+			}
+		}
+		// nobody else uses dir until the crawl ends
+		dir.items, dir.loaded = items, time.Now()
+		for _, it := range items {
+			if it.folder {
+				c.folder(sc, it)
+			}
+		}
+	}()
+}
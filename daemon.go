@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// envDaemon marks the daemon process
+const envDaemon = "_UAFS_DAEMON"
+
+// secretFd is the file descriptor of the pipe
+// used to hand the password to the daemon.
+const secretFd = 3
+
+// isDaemon reports whether this process is the daemon
+func isDaemon() bool {
+	return os.Getenv(envDaemon) == "1"
+}
+
+// daemonize starts uafs again in background writing its output
+// to logFile. pass is handed over a pipe inherited by the daemon
+// so it is not visible in its environment or arguments.
+func daemonize(logFile string, pass *secret) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	log, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envDaemon+"=1")
+	cmd.Stdin = null
+	cmd.Stdout = log
+	cmd.Stderr = log
+	// r is secretFd in the daemon
+	cmd.ExtraFiles = []*os.File{r}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(pass.Bytes())
+	return err
+}
+
+// inheritedSecret returns the password handed by daemonize
+func inheritedSecret() (*secret, error) {
+	return secretFromFile(os.NewFile(secretFd, "secret"))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"path"
 
 	"bazil.org/fuse"
@@ -11,6 +12,7 @@ import (
 type Dir struct {
 	Root *FS
 	Name string
+	// nil for the root (see FS.node)
 	item *uaitem
 }
 
@@ -18,67 +20,69 @@ var _ fs.Node = (*Dir)(nil)
 
 // Attr fills a with file attributes. Ignores context.
 func (d *Dir) Attr(_ context.Context, a *fuse.Attr) error {
+	d.Root.RLock()
 	st, err := d.Root.Fs.Stat(d.Name)
+	d.Root.RUnlock()
 	if err != nil {
 		return fuse.ENOENT
 	}
-	Info2Attr(st, a)
+	Info2Attr(st, d.item, a)
+	a.Valid = validity()
+	if d.Name == "/" {
+		a.Inode = 1
+	}
 	return nil
 }
 
-var _ fs.NodeGetxattrer = (*Dir)(nil)
-
-func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
-	return fuse.ErrNoXattr
-}
-
-var _ fs.NodeStringLookuper = (*Dir)(nil)
+var _ fs.NodeRequestLookuper = (*Dir)(nil)
 
 // Lookup search file inside directory
-func (d *Dir) Lookup(_ context.Context, name string) (fs.Node, error) {
-	f, err := d.Root.Fs.Open(d.Name)
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	err := d.Root.load(ctx, d.Name, false)
 	if err != nil {
-		return nil, err
+		return nil, toErrno(err)
 	}
-	defer f.Close()
-	files, err := f.Readdir(0)
+	files, err := d.readdir()
 	if err != nil {
 		return nil, err
 	}
 	for _, f := range files {
-		if f.Name() == name {
-			if f.IsDir() {
-				dir := &Dir{
-					Name: path.Join(d.Name, name),
-					Root: d.Root,
-				}
-				dir.Root.Fs.Mkdir(dir.Name, 0777)
-				return dir, nil
-			}
-			file := &File{
-				Root: d.Root,
-				Name: path.Join(d.Name, name),
-			}
-			ff, err := d.Root.Fs.Create(file.Name)
-			if ff == nil {
-				ff.Close()
-			}
-			return file, err
+		if f.Name() == req.Name {
+			resp.EntryValid = validity()
+			return d.Root.node(path.Join(d.Name, req.Name), f.IsDir()), nil
 		}
 	}
 	return nil, fuse.ENOENT
 }
 
+var _ fs.NodeForgetter = (*Dir)(nil)
+
+// Forget is called when the kernel forgets the directory
+func (d *Dir) Forget() {
+	d.Root.forget(d.Name, d)
+}
+
+// readdir lists the directory holding the tree lock
+func (d *Dir) readdir() ([]os.FileInfo, error) {
+	d.Root.RLock()
+	defer d.Root.RUnlock()
+	f, err := d.Root.Fs.Open(d.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(0)
+}
+
 var _ fs.HandleReadDirAller = (*Dir)(nil)
 
 // ReadDirAll returns all files in directory
-func (d *Dir) ReadDirAll(_ context.Context) ([]fuse.Dirent, error) {
-	file, err := d.Root.Fs.Open(d.Name)
+func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	err := d.Root.load(ctx, d.Name, *prefetch)
 	if err != nil {
-		return nil, err
+		return nil, toErrno(err)
 	}
-	defer file.Close()
-	files, err := file.Readdir(0)
+	files, err := d.readdir()
 	if err != nil {
 		return nil, err
 	}
@@ -88,9 +92,14 @@ func (d *Dir) ReadDirAll(_ context.Context) ([]fuse.Dirent, error) {
 		if f.IsDir() {
 			t = fuse.DT_Dir
 		}
+		var inode uint64
+		if it := d.Root.lookupItem(path.Join(d.Name, f.Name())); it != nil {
+			inode = it.inode()
+		}
 		fd = append(fd, fuse.Dirent{
-			Name: f.Name(),
-			Type: t,
+			Inode: inode,
+			Name:  f.Name(),
+			Type:  t,
 		})
 	}
 	return fd, nil
@@ -2,12 +2,19 @@ package main
 
 import (
 	"bytes"
-	"os"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
 	"path"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/erikdubbelboer/fasthttp"
+	"golang.org/x/net/context"
 )
 
 type uaitem struct {
@@ -17,35 +24,63 @@ type uaitem struct {
 	path    string
 	items   []*uaitem
 	folder  bool
+	// when items of the folder were fetched. zero if never (see load)
+	loaded time.Time
+	// size in bytes as shown by UACloud. 0 if unknown (see sizeOf)
+	size int64
+	// upload date
+	date time.Time
+	// metadata shown as extended attributes (see xattr.go)
+	title   string // title as sent by UACloud
+	subject string // subject name
+	desc    string
+	author  string
 }
 
-var (
-	rcod  = regexp.MustCompile(`data-codasi="(.*?)"`)
-	rasig = regexp.MustCompile(`<span class="asi">(.*?)</span>`)
-	rfold = regexp.MustCompile(`<div class="(.*?)" data-id`)
-)
+// key returns the cache key of the item
+func (it *uaitem) key() string {
+	return path.Join(it.codasig, it.cod)
+}
+
+// fullpath returns the path of the item in the tree
+func (it *uaitem) fullpath() string {
+	// folder paths already include their name
+	if it.folder {
+		return it.path
+	}
+	return path.Join(it.path, it.name)
+}
+
+// inode returns a stable inode number of the item
+// computed from its subject code and material id.
+func (it *uaitem) inode() uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(it.codasig))
+	// subject roots are identified by the subject code
+	if it.cod != "-1" {
+		h.Write([]byte{'/'})
+		h.Write([]byte(it.cod))
+	}
+	ino := h.Sum64()
+	// 0 means dynamic inode and 1 is the root
+	if ino < 2 {
+		ino += 2
+	}
+	return ino
+}
 
 // getFolders fetch all main folders
-func (fs *FS) getFolders() error {
-	client := fs.Client
-	cookies := fs.Cookies
+func (fs *FS) getFolders(ctx context.Context) ([]*uaitem, error) {
 	args := fasthttp.AcquireArgs()
 	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseArgs(args)
 	defer fasthttp.ReleaseRequest(req)
 	defer fasthttp.ReleaseResponse(res)
 
-	req.SetRequestURI(urlFuck)
-	err := doReqFollowRedirects(req, res, client, cookies)
+	req.SetRequestURI(endpoints.Home)
+	err := fs.ua.Do(ctx, req, res)
 	if err != nil {
-		client, cookies, err = login(
-			fs.Name, fs.Pass,
-		)
-		if err != nil {
-			return err
-		}
-		fs.Client = client
-		fs.Cookies = cookies
+		return nil, err
 	}
 	req.Reset()
 	res.Reset()
@@ -60,196 +95,365 @@ func (fs *FS) getFolders() error {
 	args.WriteTo(req.BodyWriter())
 
 	// preparing request
-	req.SetRequestURI(urlFolders)
+	req.SetRequestURI(endpoints.Folders)
 	req.Header.SetMethod("POST")
 
-	err = doReqFollowRedirects(req, res, client, cookies)
+	err = fs.ua.Do(ctx, req, res)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	body := res.Body()
-	codeMatch := rcod.FindAllSubmatch(body, -1)
-	nameMatch := rasig.FindAllSubmatch(body, -1)
-	foldMatch := rfold.FindAllSubmatch(body, -1)
-	fs.items = fs.items[:0]
-	// ignoring first
-	for i := 0; i < len(codeMatch) && i < len(nameMatch); i++ {
-		for j := 1; j < len(codeMatch[i]) && j < len(nameMatch[i]); j += 2 {
-			name := formatName(string(nameMatch[i][j]))
-			it := &uaitem{
-				folder:  bytes.Contains(foldMatch[i][j], []byte("carpeta")),
-				cod:     "-1",
-				path:    path.Join("/", name),
-				codasig: string(codeMatch[i+1][j]),
-				name:    name,
-			}
-			fs.items = append(fs.items, it)
+	// malformed subjects are skipped (see usable)
+	items, err := parseFolders(res.Body())
+	fs.names.assign("/", items)
+	return items, err
+}
+
+// transliterations used by ascii names
+var asciicodes = []string{
+	"á", "a", "à", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"Á", "A", "À", "A", "Â", "A", "Ä", "A", "Ã", "A", "Å", "A",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"É", "E", "È", "E", "Ê", "E", "Ë", "E",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"Í", "I", "Ì", "I", "Î", "I", "Ï", "I",
+	"ó", "o", "ò", "o", "ô", "o", "ö", "o", "õ", "o", "ø", "o",
+	"Ó", "O", "Ò", "O", "Ô", "O", "Ö", "O", "Õ", "O", "Ø", "O",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"Ú", "U", "Ù", "U", "Û", "U", "Ü", "U",
+	"ñ", "ny", "Ñ", "NY",
+	"ç", "c", "Ç", "C",
+	"·", ".", "º", "o", "ª", "a",
+	"€", "EUR",
+	"«", "\"", "»", "\"", "“", "\"", "”", "\"", "‘", "'", "’", "'",
+	"–", "-", "—", "-",
+	"¿", "", "¡", "",
+}
+
+var asciireplacer = strings.NewReplacer(asciicodes...)
+
+// toASCII transliterates s to ASCII.
+// Unknown characters are replaced by '_'.
+func toASCII(s string) string {
+	s = asciireplacer.Replace(s)
+	return strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return '_'
 		}
+		return r
+	}, s)
+}
+
+// formatName returns the file name of an unescaped UACloud title.
+// UTF-8 is preserved unless ascii names are selected.
+func formatName(s string) string {
+	if *asciiNames {
+		s = toASCII(s)
 	}
+	return s
+}
 
-	return nil
+// UACloud shows dates in spanish local time
+var uaLocation = func() *time.Location {
+	loc, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}()
+
+// parseDate parses listing dates like "02/03/2018 10:20" or "02/03/2018"
+func parseDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"02/01/2006 15:04:05", "02/01/2006 15:04", "02/01/2006"} {
+		t, err := time.ParseInLocation(layout, s, uaLocation)
+		if err == nil {
+			return t
+		}
+	}
+	return time.Time{}
 }
 
-var htmlescapecodes = []string{
-	"&#191;", "a",
-	"&#193;", "A",
-	"&#241;", "ny",
-	"&#225;", "a",
-	"&#233;", "e",
-	"&#237;", "i",
-	"&#243;", "o",
-	"&#250;", "u",
-	"&#209;", "NY",
-	"&#193;", "A",
-	"&#201;", "E",
-	"&#205;", "i",
-	"&#211;", "O",
-	"&#218;", "U",
+var sizeUnits = map[string]float64{
+	"b":     1,
+	"bytes": 1,
+	"kb":    1 << 10,
+	"mb":    1 << 20,
+	"gb":    1 << 30,
 }
 
-var replacer = strings.NewReplacer(htmlescapecodes...)
+// parseSize parses listing sizes like "1,5 MB" or "300 bytes"
+func parseSize(s string) int64 {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 0 {
+		return 0
+	}
+	n, err := strconv.ParseFloat(strings.Replace(fields[0], ",", ".", 1), 64)
+	if err != nil {
+		return 0
+	}
+	unit := 1.0
+	if len(fields) > 1 {
+		unit = sizeUnits[fields[1]]
+	}
+	return int64(n * unit)
+}
 
-func formatName(s string) string {
-	return replacer.Replace(s)
+// download a file waiting until it is cached
+func (fs *FS) download(ctx context.Context, item *uaitem) error {
+	t, err := fs.stream(item)
+	if err != nil {
+		return err
+	}
+	defer t.release()
+	return t.wait(ctx)
 }
 
-var (
-	rname = regexp.MustCompile(`class="nombre" >(.*?)</span>`)
-	rid   = regexp.MustCompile(`<div class="columna1">(.*?)</div>`)
-)
+// facts are sizes and content types learned by probing or
+// downloading materials, by item key. Items in the tree are read
+// by concurrent requests and never modified, so they are kept apart.
+type facts struct {
+	sync.Mutex
+	// -1 if the size cannot be probed
+	sizes  map[string]int64
+	ctypes map[string]string
+	// probes in progress
+	probes map[string]chan struct{}
+}
+
+func newFacts() *facts {
+	return &facts{
+		sizes:  make(map[string]int64),
+		ctypes: make(map[string]string),
+		probes: make(map[string]chan struct{}),
+	}
+}
+
+// learn remembers the size and content type of key
+func (f *facts) learn(key string, size int64, ctype string) {
+	f.Lock()
+	f.sizes[key] = size
+	if ctype != "" {
+		f.ctypes[key] = ctype
+	}
+	f.Unlock()
+}
+
+// forget drops what is known of keys
+func (f *facts) forget(keys []string) {
+	f.Lock()
+	for _, key := range keys {
+		delete(f.sizes, key)
+		delete(f.ctypes, key)
+	}
+	f.Unlock()
+}
+
+// ctype returns the content type of key if it has been downloaded
+func (f *facts) ctype(key string) string {
+	f.Lock()
+	defer f.Unlock()
+	return f.ctypes[key]
+}
+
+// knownSize returns the size of item without asking UACloud. 0 if unknown
+func (fs *FS) knownSize(item *uaitem) int64 {
+	if item.size > 0 {
+		return item.size
+	}
+	fs.facts.Lock()
+	defer fs.facts.Unlock()
+	if size := fs.facts.sizes[item.key()]; size > 0 {
+		return size
+	}
+	return 0
+}
+
+// sizeOf returns the size of item probing it if needed.
+// Every item is probed once, even by concurrent calls.
+// 0 if it cannot be known.
+func (fs *FS) sizeOf(ctx context.Context, item *uaitem) int64 {
+	if item.size > 0 {
+		return item.size
+	}
+	key := item.key()
+	f := fs.facts
+	for {
+		f.Lock()
+		if size, ok := f.sizes[key]; ok {
+			f.Unlock()
+			if size < 0 {
+				return 0
+			}
+			return size
+		}
+		done, ok := f.probes[key]
+		if !ok {
+			break
+		}
+		f.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return 0
+		}
+	}
+	done := make(chan struct{})
+	f.probes[key] = done
+	f.Unlock()
+
+	size, err := fs.probe(ctx, item)
+	f.Lock()
+	delete(f.probes, key)
+	switch {
+	case err == nil:
+		f.sizes[key] = size
+	case ctx.Err() == nil:
+		// do not probe again
+		f.sizes[key] = -1
+		size = 0
+	default:
+		// interrupted. Next call probes again
+		size = 0
+	}
+	f.Unlock()
+	close(done)
+	return size
+}
 
-// download a file
-func (fs *FS) download(item *uaitem) error {
-	client := fs.Client
-	cookies := fs.Cookies
+// probe asks UACloud for the size of item
+// requesting only its first byte.
+func (fs *FS) probe(ctx context.Context, item *uaitem) (int64, error) {
 	args := fasthttp.AcquireArgs()
 	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseArgs(args)
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
 
 	args.Set("identificadores", item.cod)
 	args.Set("codasis", item.codasig)
+	args.WriteTo(req.BodyWriter())
 
-	req.SetRequestURI(urlDownload)
+	req.SetRequestURI(endpoints.Download)
 	req.Header.SetContentType("application/x-www-form-urlencoded")
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8")
-	req.Header.Set("Accept-Encoding", "gzip")
 	req.Header.SetMethod("POST")
-
-	args.WriteTo(req.BodyWriter())
-	fasthttp.ReleaseArgs(args)
-
-	to := path.Join(item.path, item.name)
-
-	err := doReqFollowRedirects(req, res, client, cookies)
+	req.Header.SetByteRange(0, 0)
+	// the body is never read so the connection cannot be reused
+	req.SetConnectionClose()
+	req.Header.Set("Accept-Encoding", "identity")
+	res.SkipBody = true
+
+	// listing a folder probes all of its materials
+	err := fs.limit.wait(ctx, req.URI().Host())
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if bytes.Equal(res.Header.ContentType(), []byte("application/zip")) {
-		if !strings.Contains(path.Ext(to), ".zip") {
-			to += ".zip"
-		}
-	}
-
-	file, err := fs.Fs.OpenFile(to, os.O_APPEND|os.O_WRONLY, 0644)
+	err = fs.ua.Do(ctx, req, res)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	res.BodyWriteTo(file)
-	file.Close()
-
-	del := ""
-	fs.Lock()
-	fs.downloadFiles = append(fs.downloadFiles, to)
-	if len(fs.downloadFiles) > *maxFiles {
-		del = fs.downloadFiles[0]
-		fs.downloadFiles = fs.downloadFiles[1:]
+	size := int64(-1)
+	switch res.Header.StatusCode() {
+	case fasthttp.StatusPartialContent:
+		// Content-Range: bytes 0-0/<size>
+		cr := res.Header.Peek("Content-Range")
+		if i := bytes.LastIndexByte(cr, '/'); i >= 0 {
+			size, err = strconv.ParseInt(string(cr[i+1:]), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+		}
+	case fasthttp.StatusOK:
+		if n := res.Header.ContentLength(); n >= 0 {
+			size = int64(n)
+		}
 	}
-	fs.Unlock()
-
-	if del != "" {
-		fs.Fs.Remove(del)
-		file, err = fs.Fs.Create(del)
-		if err == nil {
-			file.Close()
+	if size < 0 {
+		return 0, &uaError{
+			kind:   kindDecode,
+			status: res.Header.StatusCode(),
+			err:    fmt.Errorf("cannot get size of %s", item.name),
 		}
 	}
+	fs.outdate(item.key(), size, string(res.Header.Peek("ETag")))
+	return size, nil
+}
 
-	fasthttp.ReleaseRequest(req)
-	fasthttp.ReleaseResponse(res)
-	return nil
+// outdate drops the cached contents of key if UACloud
+// sends a size or an ETag other than the cached ones.
+func (fs *FS) outdate(key string, size int64, etag string) {
+	e := fs.cache.get(key)
+	if e == nil {
+		return
+	}
+	if e.Size != size || etag != "" && e.ETag != "" && etag != e.ETag {
+		log.Printf("%s changed in UACloud", key)
+		fs.cache.remove(key)
+	}
 }
 
-// getItems fetch main folder items recursively
-func (fs *FS) getItems(item *uaitem) error {
-	client := fs.Client
-	cookies := fs.Cookies
+// usable reports whether items of a listing fetched with err
+// can be used. Listings with malformed rows are incomplete:
+// current items of the rows skipped have to be kept (see keepSkipped).
+func usable(items []*uaitem, err error) bool {
+	return err == nil || items != nil && errors.Is(err, errDecode)
+}
 
-	dirs := make([]*uaitem, 1)
-	dirs[0] = item
-	for inc := 0; inc < len(dirs); inc++ {
-		dirs[inc].items = dirs[inc].items[:0]
-		args := fasthttp.AcquireArgs()
-		req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+// keepSkipped adds to items of a listing fetched with err the
+// current items whose rows were skipped, so a malformed row
+// does not remove its item nor freeze the rest of the listing.
+func keepSkipped(items, current []*uaitem, err error) []*uaitem {
+	var sr *skippedRows
+	if !errors.As(err, &sr) {
+		return items
+	}
+	listed := make(map[string]bool, len(items))
+	for _, it := range items {
+		listed[it.key()] = true
+	}
+	for _, old := range current {
+		if !listed[old.key()] && sr.has(old.key()) {
+			items = append(items, old)
+		}
+	}
+	return items
+}
 
-		args.Set("idmat", dirs[inc].cod)
-		args.Set("codasi", item.codasig)
-		args.Set("expresion", "")
-		args.Set("direccion", "")
-		args.Set("filtro", "")
-		args.Set("pendientes", "N")
-		args.Set("fechadesde", "")
-		args.Set("fechahasta", "")
-		args.Set("busquedarapida", "N")
-		args.Set("idgrupo", "")
+// getFolder fetch items inside folder dir of subject
+func (fs *FS) getFolder(ctx context.Context, subject, dir *uaitem) ([]*uaitem, error) {
+	args := fasthttp.AcquireArgs()
+	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseArgs(args)
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
 
-		args.WriteTo(req.BodyWriter())
+	args.Set("idmat", dir.cod)
+	args.Set("codasi", subject.codasig)
+	args.Set("expresion", "")
+	args.Set("direccion", "")
+	args.Set("filtro", "")
+	args.Set("pendientes", "N")
+	args.Set("fechadesde", "")
+	args.Set("fechahasta", "")
+	args.Set("busquedarapida", "N")
+	args.Set("idgrupo", "")
 
-		req.Header.SetContentType("application/x-www-form-urlencoded; charset=UTF-8")
-		req.Header.SetMethod("POST")
-		req.SetRequestURI(urlFiles)
+	args.WriteTo(req.BodyWriter())
 
-		err := doReqFollowRedirects(req, res, client, cookies)
-		if err != nil {
-			return err
-		}
-		body := res.Body()
-
-		fasthttp.ReleaseArgs(args)
-		fasthttp.ReleaseRequest(req)
-		fasthttp.ReleaseResponse(res)
-
-		idMatch := rid.FindAllSubmatch(body, -1)
-		nameMatch := rname.FindAllSubmatch(body, -1)
-		dirMatch := rfold.FindAllSubmatch(body, -1)
-		for i := 0; i < len(idMatch); i++ {
-		sloop:
-			for j := 1; j < len(idMatch[i]); j += 2 {
-				folder := bytes.Contains(dirMatch[i][j], []byte("carpeta"))
-				if !folder {
-					if !bytes.Contains(dirMatch[i][j], []byte("archivo")) {
-						continue sloop
-					}
-				}
-				cod := string(idMatch[i][j])
-				name := string(nameMatch[i][j])
-				it := &uaitem{
-					cod:     cod,
-					codasig: dirs[inc].codasig,
-					path:    dirs[inc].path,
-					name:    formatName(name),
-					folder:  folder,
-				}
-				if folder {
-					it.path = path.Join(it.path, it.name)
-					dirs = append(dirs, it)
-				}
-				dirs[inc].items = append(dirs[inc].items, it)
-			}
-		}
+	req.Header.SetContentType("application/x-www-form-urlencoded; charset=UTF-8")
+	req.Header.SetMethod("POST")
+	req.SetRequestURI(endpoints.Files)
 
-		// deleting processed dir
-		dirs = dirs[1:]
-		inc--
+	err := fs.limit.wait(ctx, req.URI().Host())
+	if err != nil {
+		return nil, err
+	}
+	err = fs.ua.Do(ctx, req, res)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	// malformed items are skipped (see usable)
+	items, err := parseItems(dir, res.Body())
+	fs.names.assign(dir.path, items)
+	return items, err
 }
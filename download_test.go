@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+// inodes returns inode numbers of items and their descendants by path
+func inodes(items []*uaitem, m map[string]uint64) map[string]uint64 {
+	for _, it := range items {
+		m[it.fullpath()] = it.inode()
+		inodes(it.items, m)
+	}
+	return m
+}
+
+func TestInodes(t *testing.T) {
+	startFake(t, testSubjects()...)
+	root := testFS(t)
+	if err := root.fetch(); err != nil {
+		t.Fatal(err)
+	}
+	root.RLock()
+	first := inodes(root.items, make(map[string]uint64))
+	root.RUnlock()
+	if len(first) != 6 {
+		t.Fatalf("got %d items, want 6", len(first))
+	}
+
+	seen := make(map[uint64]string)
+	for p, ino := range first {
+		if ino < 2 {
+			t.Errorf("%s: reserved inode %d", p, ino)
+		}
+		if other, ok := seen[ino]; ok {
+			t.Errorf("%s and %s share inode %d", p, other, ino)
+		}
+		seen[ino] = p
+	}
+
+	// the tree is rebuilt by every fetch and by a new mount
+	if err := root.fetch(); err != nil {
+		t.Fatal(err)
+	}
+	other := testFS(t)
+	if err := other.fetch(); err != nil {
+		t.Fatal(err)
+	}
+	for _, fs := range []*FS{root, other} {
+		fs.RLock()
+		got := inodes(fs.items, make(map[string]uint64))
+		fs.RUnlock()
+		for p, ino := range first {
+			if got[p] != ino {
+				t.Errorf("%s: inode %d changed to %d", p, ino, got[p])
+			}
+		}
+	}
+}
+
+func TestToASCII(t *testing.T) {
+	for s, want := range map[string]string{
+		"Prácticas":     "Practicas",
+		"Año 2018.pdf":  "Anyo 2018.pdf",
+		"ESPAÑA":        "ESPANYA",
+		"¿Qué?":         "Que?",
+		"«Niño» – 1º":   "\"Ninyo\" - 1o",
+		"Precio 5€.txt": "Precio 5EUR.txt",
+		"plain.txt":     "plain.txt",
+		// unknown characters
+		"日本.txt":           "__.txt",
+		"e\u0301xamen.pdf": "e_xamen.pdf",
+	} {
+		if got := toASCII(s); got != want {
+			t.Errorf("%q: got %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestASCIINames(t *testing.T) {
+	defer func(v bool) { *asciiNames = v }(*asciiNames)
+	*asciiNames = true
+
+	// names equal after transliteration are told apart
+	items := []*uaitem{
+		{codasig: "34012", cod: "1002", title: "Año.txt"},
+		{codasig: "34012", cod: "1001", title: "Anyo.txt"},
+		{codasig: "34012", cod: "1003", title: "日本.txt"},
+		{codasig: "34012", cod: "1004", title: "中国.txt"},
+		{codasig: "34012", cod: "1005", title: "Tema ñ.pdf"},
+	}
+	newNamer().assign("/FC", items)
+	want := []string{
+		"Anyo [1002].txt",
+		"Anyo [1001].txt",
+		"__ [1003].txt",
+		"__ [1004].txt",
+		"Tema ny.pdf",
+	}
+	for i, it := range items {
+		if it.name != want[i] {
+			t.Errorf("%q: got %q, want %q", it.title, it.name, want[i])
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// errKind classifies errors talking to UACloud
+type errKind int
+
+const (
+	// connection errors and timeouts
+	kindNetwork errKind = iota
+	// bad credentials
+	kindAuth
+	// UACloud denies access to the resource (403).
+	// Logging in again does not help
+	kindForbidden
+	// UACloud sent us to the CAS login
+	kindExpired
+	kindNotFound
+	// other 4xx. Sending the request again does not help
+	kindClient
+	// 5xx and unexpected responses
+	kindServer
+	kindRateLimited
+	// bodies that cannot be decoded
+	kindDecode
+)
+
+var kindNames = [...]string{
+	kindNetwork:     "network error",
+	kindAuth:        "authentication failed",
+	kindForbidden:   "access denied",
+	kindExpired:     "session expired",
+	kindNotFound:    "not found",
+	kindClient:      "bad request",
+	kindServer:      "server error",
+	kindRateLimited: "rate limited",
+	kindDecode:      "cannot decode response",
+}
+
+// uaError is an error talking to UACloud.
+//
+// It can be compared with the sentinels below using errors.Is
+// and FUSE handlers return it as an errno (see toErrno).
+type uaError struct {
+	kind errKind
+	// HTTP status code if any
+	status int
+	err    error
+}
+
+var (
+	errNetwork     = &uaError{kind: kindNetwork}
+	errAuthFailed  = &uaError{kind: kindAuth}
+	errForbidden   = &uaError{kind: kindForbidden}
+	errExpired     = &uaError{kind: kindExpired}
+	errNotFound    = &uaError{kind: kindNotFound}
+	errClient      = &uaError{kind: kindClient}
+	errServer      = &uaError{kind: kindServer}
+	errRateLimited = &uaError{kind: kindRateLimited}
+	errDecode      = &uaError{kind: kindDecode}
+)
+
+func (e *uaError) Error() string {
+	s := kindNames[e.kind]
+	if e.status != 0 {
+		s = fmt.Sprintf("%s (status %d)", s, e.status)
+	}
+	if e.err != nil {
+		s += ": " + e.err.Error()
+	}
+	return s
+}
+
+func (e *uaError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is a uaError of the same kind
+func (e *uaError) Is(target error) bool {
+	t, ok := target.(*uaError)
+	return ok && t.kind == e.kind
+}
+
+// temporary reports whether the request can be retried:
+// network errors, 5xx and 429
+func (e *uaError) temporary() bool {
+	switch e.kind {
+	case kindNetwork, kindRateLimited:
+		return true
+	case kindServer:
+		// not unexpected redirects
+		return e.status == 0 || e.status >= 500
+	}
+	return false
+}
+
+// Errno implements fuse.ErrorNumber
+func (e *uaError) Errno() fuse.Errno {
+	switch e.kind {
+	case kindAuth, kindExpired, kindForbidden:
+		return fuse.Errno(syscall.EACCES)
+	case kindNotFound:
+		return fuse.ENOENT
+	case kindRateLimited:
+		return fuse.Errno(syscall.EAGAIN)
+	}
+	return fuse.EIO
+}
+
+var _ fuse.ErrorNumber = (*uaError)(nil)
+
+// statusError returns the error of an unexpected status code
+func statusError(status int) error {
+	e := &uaError{
+		kind:   kindServer,
+		status: status,
+	}
+	switch {
+	case status == 401:
+		e.kind = kindAuth
+	case status == 403:
+		e.kind = kindForbidden
+	case status == 404 || status == 410:
+		e.kind = kindNotFound
+	case status == 429:
+		e.kind = kindRateLimited
+	case status >= 400 && status < 500:
+		e.kind = kindClient
+	}
+	return e
+}
+
+// toErrno returns err as an error FUSE understands.
+// Wrapped UACloud errors are unwrapped so they keep their errno.
+func toErrno(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled):
+		// interrupted by the kernel
+		return fuse.EINTR
+	case errors.Is(err, context.DeadlineExceeded):
+		return fuse.Errno(syscall.ETIMEDOUT)
+	}
+	var ue *uaError
+	if errors.As(err, &ue) {
+		return ue.Errno()
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/LibreLABUA/uafs/fakeua"
+	"golang.org/x/net/context"
+)
+
+func TestStatusError(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		err    error
+		errno  fuse.Errno
+		retry  bool
+	}{
+		{401, errAuthFailed, fuse.Errno(syscall.EACCES), false},
+		{403, errForbidden, fuse.Errno(syscall.EACCES), false},
+		{404, errNotFound, fuse.ENOENT, false},
+		{410, errNotFound, fuse.ENOENT, false},
+		{400, errClient, fuse.EIO, false},
+		{416, errClient, fuse.EIO, false},
+		{429, errRateLimited, fuse.Errno(syscall.EAGAIN), true},
+		{500, errServer, fuse.EIO, true},
+		{503, errServer, fuse.EIO, true},
+	} {
+		err := statusError(tt.status)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%d: got %v, want %v", tt.status, err, tt.err)
+		}
+		if got := toErrno(err); got != tt.errno {
+			t.Errorf("%d: got errno %v, want %v", tt.status, got, tt.errno)
+		}
+		if got := err.(*uaError).temporary(); got != tt.retry {
+			t.Errorf("%d: retried %v, want %v", tt.status, got, tt.retry)
+		}
+	}
+}
+
+func TestToErrno(t *testing.T) {
+	for _, tt := range []struct {
+		err   error
+		errno error
+	}{
+		{nil, nil},
+		{context.Canceled, fuse.EINTR},
+		{context.DeadlineExceeded, fuse.Errno(syscall.ETIMEDOUT)},
+		{fmt.Errorf("fetching: %w", errExpired), fuse.Errno(syscall.EACCES)},
+		{&uaError{kind: kindNetwork}, fuse.EIO},
+		{&uaError{kind: kindDecode}, fuse.EIO},
+	} {
+		if got := toErrno(tt.err); got != tt.errno {
+			t.Errorf("%v: got %v, want %v", tt.err, got, tt.errno)
+		}
+	}
+}
+
+func TestClientErrorsNotRetried(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	for _, status := range []int{400, 416} {
+		before := srv.Requests(fakeua.FoldersPath)
+		srv.Fail(fakeua.FoldersPath, status)
+		if _, err := root.getFolders(context.Background()); !errors.Is(err, errClient) {
+			t.Errorf("%d: got %v, want %v", status, err, errClient)
+		}
+		if n := srv.Requests(fakeua.FoldersPath) - before; n != 1 {
+			t.Errorf("%d: sent %d times", status, n)
+		}
+	}
+}
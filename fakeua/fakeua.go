@@ -0,0 +1,556 @@
+// Package fakeua is a fake UACloud: a CAS login server and the
+// uaMatDocente materials application serving a fixture tree.
+//
+// It runs in memory (see Start and Dial) so uafs can be exercised
+// offline, or on any listener (see Serve) to mount it by hand using
+// uafs -uacloud and -cas flags.
+package fakeua
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erikdubbelboer/fasthttp"
+	"github.com/erikdubbelboer/fasthttp/fasthttputil"
+)
+
+// URL is the base URL of the in-memory server
+const URL = "http://uacloud.test"
+
+// paths of the endpoints. They are the same as the real ones.
+const (
+	CASPath      = "/cas"
+	HomePath     = "/uaMatDocente/Materiales/MaterialesAlumno"
+	FoldersPath  = "/uamatdocente/Materiales/CursoMaterialesTodos"
+	FilesPath    = "/uamatdocente/Materiales/VistaMateriales"
+	DownloadPath = "/uamatdocente/Materiales/DescargarArchivoAlu"
+)
+
+// cookie names
+const (
+	// CAS ticket granting cookie
+	tgcCookie = "TGC"
+	// uaMatDocente session
+	sessionCookie = "ASP.NET_SessionId"
+)
+
+// Subject is a subject of the fixture
+type Subject struct {
+	Code  string
+	Name  string
+	Items []*Item
+	// FailWith is the status code answered to listings
+	// of the subject. 0 answers them
+	FailWith int
+	// Malformed breaks the row of the subject
+	// in the list of subjects
+	Malformed bool
+}
+
+// Item is a file or a folder of a subject
+type Item struct {
+	// material id. Assigned by New if empty
+	ID     string
+	Name   string
+	Author string
+	Desc   string
+	Date   time.Time
+	// file contents
+	Content []byte
+	// folder contents
+	Folder bool
+	Items  []*Item
+	// HideSize omits the size in listings
+	HideSize bool
+}
+
+// Server is a fake UACloud
+type Server struct {
+	// Users maps user names to passwords
+	Users    map[string]string
+	Subjects []*Subject
+	// NoRanges makes downloads ignore Range headers
+	NoRanges bool
+
+	// guards Subjects while they are served (see Update)
+	tree sync.RWMutex
+	mu   sync.Mutex
+	// issued execution tokens, tickets, TGCs and sessions
+	executions map[string]bool
+	tickets    map[string]string
+	tgcs       map[string]string
+	sessions   map[string]string
+	// requests by path
+	requests map[string]int
+	// failures to inject by path (see Fail)
+	failures map[string][]int
+	// stalled requests by path (see Stall)
+	stalls map[string]stall
+	serial int
+
+	ln  *fasthttputil.InmemoryListener
+	srv *fasthttp.Server
+}
+
+// New returns a server with the given users and fixture tree.
+// Items without ID get a unique one.
+func New(users map[string]string, subjects ...*Subject) *Server {
+	s := &Server{
+		Users:      users,
+		Subjects:   subjects,
+		executions: make(map[string]bool),
+		tickets:    make(map[string]string),
+		tgcs:       make(map[string]string),
+		sessions:   make(map[string]string),
+		requests:   make(map[string]int),
+		failures:   make(map[string][]int),
+		stalls:     make(map[string]stall),
+	}
+	id := 1000
+	var walk func(items []*Item)
+	walk = func(items []*Item) {
+		for _, it := range items {
+			if it.ID == "" {
+				id++
+				it.ID = strconv.Itoa(id)
+			}
+			walk(it.Items)
+		}
+	}
+	for _, sub := range subjects {
+		walk(sub.Items)
+	}
+	s.srv = &fasthttp.Server{
+		Name:    "fakeua",
+		Handler: s.handle,
+	}
+	return s
+}
+
+// Start serves s in memory. Use Dial to connect.
+func (s *Server) Start() {
+	s.ln = fasthttputil.NewInmemoryListener()
+	go s.srv.Serve(s.ln)
+}
+
+// Dial connects to the in-memory server ignoring addr.
+// It is a fasthttp.DialFunc.
+func (s *Server) Dial(addr string) (net.Conn, error) {
+	return s.ln.Dial()
+}
+
+// Serve serves s on ln
+func (s *Server) Serve(ln net.Listener) error {
+	return s.srv.Serve(ln)
+}
+
+// Close stops the in-memory server
+func (s *Server) Close() error {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+// Expire forgets all sessions so every client has to log in again
+func (s *Server) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tgcs = make(map[string]string)
+	s.sessions = make(map[string]string)
+}
+
+// ExpireSessions forgets uaMatDocente sessions keeping CAS logins,
+// so clients are sent back with a new ticket without logging in
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]string)
+}
+
+// Fail makes the next requests to path answer the given status codes
+func (s *Server) Fail(path string, status ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], status...)
+}
+
+// stall is a request kept waiting (see Stall)
+type stall struct {
+	// request number
+	at      int
+	release chan struct{}
+}
+
+// Stall makes the n-th next request to path wait before
+// being answered until the returned func is called
+func (s *Server) Stall(path string, n int) (release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := stall{
+		at:      s.requests[path] + n,
+		release: make(chan struct{}),
+	}
+	s.stalls[path] = st
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(st.release) })
+	}
+}
+
+// Update runs fn while no request reads the fixture tree,
+// so it can be changed while it is served
+func (s *Server) Update(fn func()) {
+	s.tree.Lock()
+	defer s.tree.Unlock()
+	fn()
+}
+
+// Requests returns how many requests to path have been served
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// token returns a new random-looking token. s must be locked
+func (s *Server) token(prefix string) string {
+	s.serial++
+	h := sha1.Sum([]byte(fmt.Sprintf("%p%d%d", s, s.serial, time.Now().UnixNano())))
+	return prefix + hex.EncodeToString(h[:8])
+}
+
+func (s *Server) handle(ctx *fasthttp.RequestCtx) {
+	p := string(ctx.Path())
+	s.mu.Lock()
+	s.requests[p]++
+	if f := s.failures[p]; len(f) > 0 {
+		s.failures[p] = f[1:]
+		s.mu.Unlock()
+		ctx.SetStatusCode(f[0])
+		return
+	}
+	if st, ok := s.stalls[p]; ok && st.at == s.requests[p] {
+		delete(s.stalls, p)
+		s.mu.Unlock()
+		<-st.release
+	} else {
+		s.mu.Unlock()
+	}
+
+	if strings.HasPrefix(p, CASPath+"/") {
+		s.handleCAS(ctx)
+		return
+	}
+	if !s.authorized(ctx) {
+		return
+	}
+	s.tree.RLock()
+	defer s.tree.RUnlock()
+	switch p {
+	case HomePath:
+		ctx.SuccessString("text/html; charset=utf-8", "<html><body><h1>Materiales</h1></body></html>")
+	case FoldersPath:
+		s.handleFolders(ctx)
+	case FilesPath:
+		s.handleFiles(ctx)
+	case DownloadPath:
+		s.handleDownload(ctx)
+	default:
+		ctx.NotFound()
+	}
+}
+
+// baseURL returns the URL the client used to reach s
+func baseURL(ctx *fasthttp.RequestCtx) string {
+	return "http://" + string(ctx.Host())
+}
+
+// redirect redirects to the absolute URL u
+func redirect(ctx *fasthttp.RequestCtx, u string) {
+	ctx.Response.Header.Set("Location", u)
+	ctx.SetStatusCode(fasthttp.StatusFound)
+}
+
+func setCookie(ctx *fasthttp.RequestCtx, key, value, path string) {
+	c := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(c)
+	c.SetKey(key)
+	c.SetValue(value)
+	c.SetPath(path)
+	c.SetHTTPOnly(true)
+	ctx.Response.Header.SetCookie(c)
+}
+
+// authorized checks the session of the request like uaMatDocente:
+// unknown clients are sent to the CAS login and tickets
+// are exchanged for a session.
+func (s *Server) authorized(ctx *fasthttp.RequestCtx) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ticket := ctx.QueryArgs().Peek("ticket"); len(ticket) > 0 {
+		user, ok := s.tickets[string(ticket)]
+		delete(s.tickets, string(ticket))
+		if !ok {
+			ctx.Error("invalid ticket", fasthttp.StatusForbidden)
+			return false
+		}
+		session := s.token("")
+		s.sessions[session] = user
+		setCookie(ctx, sessionCookie, session, "/")
+		// removing the ticket from the URL
+		u := ctx.URI()
+		args := fasthttp.AcquireArgs()
+		defer fasthttp.ReleaseArgs(args)
+		ctx.QueryArgs().CopyTo(args)
+		args.Del("ticket")
+		target := baseURL(ctx) + string(u.Path())
+		if args.Len() > 0 {
+			target += "?" + args.String()
+		}
+		redirect(ctx, target)
+		return false
+	}
+	if _, ok := s.sessions[string(ctx.Request.Header.Cookie(sessionCookie))]; ok {
+		return true
+	}
+	service := baseURL(ctx) + string(ctx.Path())
+	redirect(ctx, baseURL(ctx)+CASPath+"/login?service="+url.QueryEscape(service))
+	return false
+}
+
+// loginForm answers the CAS login form
+func (s *Server) loginForm(ctx *fasthttp.RequestCtx, status int) {
+	s.mu.Lock()
+	execution := s.token("e1s1-")
+	s.executions[execution] = true
+	s.mu.Unlock()
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("text/html; charset=utf-8")
+	fmt.Fprintf(ctx, `<html><body><form id="fm1" method="post">
+<input id="username" name="username" type="text"/>
+<input id="password" name="password" type="password"/>
+<input type="hidden" name="execution" value="%s"/>
+<input type="hidden" name="_eventId" value="submit"/>
+</form></body></html>`, execution)
+}
+
+// grant sends the client back to service with a ticket for user
+func (s *Server) grant(ctx *fasthttp.RequestCtx, user, service string) {
+	s.mu.Lock()
+	ticket := s.token("ST-")
+	s.tickets[ticket] = user
+	s.mu.Unlock()
+	sep := "?"
+	if strings.Contains(service, "?") {
+		sep = "&"
+	}
+	redirect(ctx, service+sep+"ticket="+ticket)
+}
+
+func (s *Server) handleCAS(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Path()) != CASPath+"/login" {
+		ctx.NotFound()
+		return
+	}
+	service := string(ctx.QueryArgs().Peek("service"))
+
+	if !ctx.IsPost() {
+		// single sign on
+		s.mu.Lock()
+		user, ok := s.tgcs[string(ctx.Request.Header.Cookie(tgcCookie))]
+		s.mu.Unlock()
+		if ok && service != "" {
+			s.grant(ctx, user, service)
+			return
+		}
+		s.loginForm(ctx, fasthttp.StatusOK)
+		return
+	}
+
+	args := ctx.PostArgs()
+	execution := string(args.Peek("execution"))
+	user := string(args.Peek("username"))
+	s.mu.Lock()
+	valid := s.executions[execution]
+	delete(s.executions, execution)
+	pass, ok := s.Users[user]
+	s.mu.Unlock()
+	if !valid {
+		// flow expired
+		s.loginForm(ctx, fasthttp.StatusOK)
+		return
+	}
+	if !ok || pass != string(args.Peek("password")) {
+		s.loginForm(ctx, fasthttp.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	tgc := s.token("TGT-")
+	s.tgcs[tgc] = user
+	s.mu.Unlock()
+	setCookie(ctx, tgcCookie, tgc, CASPath)
+	if service == "" {
+		ctx.SuccessString("text/html; charset=utf-8", "<html><body>Log In Successful</body></html>")
+		return
+	}
+	s.grant(ctx, user, service)
+}
+
+// subject returns the subject with code or nil
+func (s *Server) subject(code string) *Subject {
+	for _, sub := range s.Subjects {
+		if sub.Code == code {
+			return sub
+		}
+	}
+	return nil
+}
+
+// find returns the item with id inside items or nil
+func find(items []*Item, id string) *Item {
+	for _, it := range items {
+		if it.ID == id {
+			return it
+		}
+		if f := find(it.Items, id); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleFolders(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/html; charset=utf-8")
+	fmt.Fprintf(ctx, "<html><body><table>\n")
+	for _, sub := range s.Subjects {
+		broken := ""
+		if sub.Malformed {
+			// unterminated attribute value
+			broken = `<td title="roto></td>`
+		}
+		fmt.Fprintf(ctx, `<tr data-codasi="%s"><td><span class="asi">%s</span></td>%s</tr>`+"\n",
+			html.EscapeString(sub.Code), html.EscapeString(sub.Name), broken)
+	}
+	fmt.Fprintf(ctx, "</table></body></html>")
+}
+
+func (s *Server) handleFiles(ctx *fasthttp.RequestCtx) {
+	args := ctx.PostArgs()
+	sub := s.subject(string(args.Peek("codasi")))
+	if sub == nil {
+		ctx.NotFound()
+		return
+	}
+	if sub.FailWith != 0 {
+		ctx.SetStatusCode(sub.FailWith)
+		return
+	}
+	items := sub.Items
+	if id := string(args.Peek("idmat")); id != "-1" && id != "" {
+		folder := find(sub.Items, id)
+		if folder == nil || !folder.Folder {
+			ctx.NotFound()
+			return
+		}
+		items = folder.Items
+	}
+
+	ctx.SetContentType("text/html; charset=utf-8")
+	fmt.Fprintf(ctx, "<html><body><table>\n")
+	for _, it := range items {
+		class, size := "archivo", ""
+		if it.Folder {
+			class = "carpeta"
+		} else if !it.HideSize {
+			size = strconv.Itoa(len(it.Content)) + " bytes"
+		}
+		date := ""
+		if !it.Date.IsZero() {
+			date = it.Date.Format("02/01/2006 15:04")
+		}
+		fmt.Fprintf(ctx, `<tr data-id="%s" class="%s"><td class="columna1">%s</td>`+
+			`<td class="nombre">%s</td><td class="columna3">%s</td><td class="columna4">%s</td>`+
+			`<td class="autor">%s</td><td class="descripcion">%s</td></tr>`+"\n",
+			it.ID, class, it.ID, html.EscapeString(it.Name), date, size,
+			html.EscapeString(it.Author), html.EscapeString(it.Desc))
+	}
+	fmt.Fprintf(ctx, "</table></body></html>")
+}
+
+func (s *Server) handleDownload(ctx *fasthttp.RequestCtx) {
+	args := ctx.PostArgs()
+	sub := s.subject(string(args.Peek("codasis")))
+	if sub == nil {
+		ctx.NotFound()
+		return
+	}
+	it := find(sub.Items, string(args.Peek("identificadores")))
+	if it == nil || it.Folder {
+		ctx.NotFound()
+		return
+	}
+
+	content := it.Content
+	h := sha1.Sum(content)
+	ctype := mime.TypeByExtension(path.Ext(it.Name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	ctx.Response.Header.Set("ETag", `"`+hex.EncodeToString(h[:8])+`"`)
+	ctx.Response.Header.Set("Content-Disposition", `attachment; filename="`+it.Name+`"`)
+	ctx.SetContentType(ctype)
+
+	start, end, ok := byteRange(ctx.Request.Header.Peek("Range"), len(content))
+	if s.NoRanges || !ok {
+		ctx.SetBody(content)
+		return
+	}
+	if start >= len(content) {
+		ctx.Response.Header.Set("Content-Range", "bytes */"+strconv.Itoa(len(content)))
+		ctx.SetStatusCode(fasthttp.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	ctx.Response.Header.SetContentRange(start, end, len(content))
+	ctx.SetStatusCode(fasthttp.StatusPartialContent)
+	ctx.SetBody(content[start : end+1])
+}
+
+// byteRange parses a "bytes=start-end" Range header
+// returning the last byte clamped to size.
+func byteRange(r []byte, size int) (start, end int, ok bool) {
+	spec := strings.TrimPrefix(string(r), "bytes=")
+	if spec == string(r) || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	i := strings.IndexByte(spec, '-')
+	if i <= 0 {
+		return 0, 0, false
+	}
+	start, err := strconv.Atoi(spec[:i])
+	if err != nil {
+		return 0, 0, false
+	}
+	end = size - 1
+	if spec[i+1:] != "" {
+		end, err = strconv.Atoi(spec[i+1:])
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
@@ -1,165 +1,118 @@
 package main
 
 import (
-	"io"
-	"sync"
-	"time"
+	"os"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"github.com/spf13/afero"
 	"golang.org/x/net/context"
 )
 
-const byteSize = 1024
-
-var (
-	bytePool = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, byteSize)
-		},
-	}
-)
-
 type File struct {
 	Name string
 	Root *FS
-	file afero.File
+	// nil if it was removed (see FS.node)
 	item *uaitem
 }
 
 var _ fs.Node = (*File)(nil)
 
 // Attr writes file attributes to attr
-func (f *File) Attr(_ context.Context, attr *fuse.Attr) error {
-	st, err := f.Root.Fs.Stat(f.Name)
+func (f *File) Attr(ctx context.Context, attr *fuse.Attr) error {
+	st, err := f.stat()
 	if err != nil {
 		return fuse.ENOENT
 	}
-	Info2Attr(st, attr)
+	Info2Attr(st, f.item, attr)
+	if attr.Size == 0 && f.item != nil {
+		// listing did not show the size
+		attr.Size = uint64(f.Root.sizeOf(ctx, f.item))
+	}
+	attr.Valid = validity()
+	if attr.Size == 0 {
+		// known when it is downloaded
+		attr.Valid = 0
+	}
 	return nil
 }
 
-var _ fs.NodeOpener = (*File)(nil)
+var _ fs.NodeForgetter = (*File)(nil)
 
-// Open opens a file
-func (f *File) Open(_ context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	defer f.Root.Fs.Chtimes(f.Name, time.Now(), time.Now())
-	err := f.fill()
-	if err != nil {
-		return nil, err
-	}
-	if f.file != nil {
-		f.file.Close()
-		f.file = nil
-	}
-	f.file, err = f.Root.Fs.OpenFile(f.Name, int(req.Flags), 0644)
-	if err != nil {
-		return nil, err
-	}
-	return f, nil
+// Forget is called when the kernel forgets the file
+func (f *File) Forget() {
+	f.Root.forget(f.Name, f)
 }
 
-// fill download file from UACloud
-func (f *File) fill() error {
+var _ fs.NodeOpener = (*File)(nil)
+
+// Open opens a file returning a new handle.
+//
+// Files not cached yet are read while they are downloaded
+// unless they are opened for writing.
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	if f.item == nil {
-		f.item = lookup(f.Root.items, f.Name)
-		if f.item == nil {
-			panic("not found")
-		}
+		return nil, fuse.ENOENT
 	}
-	st, err := f.Root.Fs.Stat(f.Name)
-	if err != nil {
-		return f.Root.download(f.item)
+	h := &handle{
+		File: f,
+		key:  f.item.key(),
 	}
-	if st.Size() == 0 || (st.IsDir() && st.Size() == 64) {
-		return f.Root.download(f.item)
+	if req.Flags.IsReadOnly() && !f.Root.cache.hit(h.key) {
+		t, err := f.Root.stream(f.item)
+		if err != nil {
+			return nil, toErrno(err)
+		}
+		h.stream = t
+		if f.Root.knownSize(f.item) == 0 {
+			// reads must not stop at the size reported by Attr
+			resp.Flags |= fuse.OpenDirectIO
+		}
+		return h, nil
 	}
-	return nil
-}
-
-var _ fs.HandleReadAller = (*File)(nil)
 
-// ReadAll reads all file contents
-func (f *File) ReadAll(_ context.Context) ([]byte, error) {
-	defer f.Root.Fs.Chtimes(f.Name, time.Now(), time.Now())
-	err := f.fill()
+	err := f.acquire(ctx)
 	if err != nil {
-		return nil, err
+		return nil, toErrno(err)
 	}
-	bf := bytePool.Get().([]byte)
-	b := bytePool.Get().([]byte)
-
-	var n int
-	nn := 0
-	if f.file != nil {
-		f.file.Close()
-	}
-	f.file, err = f.Root.Fs.Open(f.Name)
+	h.file, err = f.Root.cache.Fs.OpenFile(h.key, int(req.Flags), 0644)
 	if err != nil {
-		goto end
-	}
-	for {
-		n, err = f.file.Read(b)
-		if err != nil {
-			break
-		}
-		bf = append(bf[:nn], b[:n]...)
-		nn += n
-	}
-end:
-	if err == io.EOF {
-		err = nil
+		f.Root.cache.unpin(h.key)
+		return nil, err
 	}
-	f.file.Close()
-	f.file = nil
-	bytePool.Put(b)
-	return bf[:nn], err
+	return h, nil
 }
 
-var _ fs.HandleReader = (*File)(nil)
-
-// Read reads file contents
-func (f *File) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
-	defer f.Root.Fs.Chtimes(f.Name, time.Now(), time.Now())
-	var n int
-	if f.file == nil {
-		err = fuse.ENOTSUP
-		goto end
-	}
-	n, err = f.file.ReadAt(resp.Data[:req.Size], req.Offset)
-	resp.Data = resp.Data[:n]
-end:
-	if err == io.EOF {
-		err = nil
+// acquire downloads the file if it is not cached
+// and pins it so it cannot be evicted while in use.
+func (f *File) acquire(ctx context.Context) error {
+	if f.item == nil {
+		return fuse.ENOENT
 	}
-	return
-}
-
-var _ fs.HandleReleaser = (*File)(nil)
-
-// Release close file object
-func (f *File) Release(_ context.Context, req *fuse.ReleaseRequest) error {
-	defer f.Root.Fs.Chtimes(f.Name, time.Now(), time.Now())
-	if f.file != nil {
-		f.file.Close()
-		f.file = nil
+	for i := 0; i < 2; i++ {
+		if !f.Root.cache.hit(f.item.key()) {
+			err := f.Root.download(ctx, f.item)
+			if err != nil {
+				return err
+			}
+		}
+		if f.Root.cache.pin(f.item.key()) {
+			return nil
+		}
+		// evicted between download and pin
 	}
-	return nil
+	return fuse.EIO
 }
 
-var _ fs.HandleWriter = (*File)(nil)
-
-// Write writes in a file
-func (f *File) Write(_ context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
-	defer f.Root.Fs.Chtimes(f.Name, time.Now(), time.Now())
-	var n int
-	if f.file == nil {
-		err = fuse.ENOTSUP
-		goto end
+// stat returns cached file info
+// or tree file info if it has not been downloaded yet.
+func (f *File) stat() (os.FileInfo, error) {
+	if f.item != nil && f.Root.cache.get(f.item.key()) != nil {
+		st, err := f.Root.cache.Fs.Stat(f.item.key())
+		if err == nil {
+			return st, nil
+		}
 	}
-	n, err = f.file.WriteAt(req.Data, req.Offset)
-	resp.Size = n
-end:
-	return err
+	f.Root.RLock()
+	defer f.Root.RUnlock()
+	return f.Root.Fs.Stat(f.Name)
 }
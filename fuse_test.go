@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fs/fstestutil"
+	"github.com/LibreLABUA/uafs/fakeua"
+)
+
+// mountFS mounts root like mount does returning the mount point.
+// Tests are skipped where FUSE cannot be used.
+func mountFS(t *testing.T, root *FS) string {
+	t.Helper()
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("FUSE not available:", err)
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skip("FUSE not available:", err)
+	}
+	// folders are fetched when they are listed (see load)
+	if err := root.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	mnt, err := fstestutil.MountedFuncT(t, func(mnt *fstestutil.Mount) fs.FS {
+		root.server = mnt.Server
+		return root
+	}, nil, fuse.FSName("uafs"), fuse.Subtype("uafs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mnt.Close)
+	return mnt.Dir
+}
+
+// open opens name for reading without os.Open: it adds the file to
+// the poller and the kernel asks the server for FUSE_POLL while the
+// runtime cannot schedule it, which deadlocks when both share a process.
+func open(name string) (*os.File, error) {
+	fd, err := syscall.Open(name, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// unpinned waits until handles of the cache are released.
+// The kernel releases them after close returns.
+func unpinned(t *testing.T, root *FS) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if root.cache.Stats().Pinned == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("cache entries still pinned: %s", root.cache.Stats())
+}
+
+// TestTwoHandles checks releasing a handle does not affect other
+// handles of the same material, both while it is downloaded
+// (streaming) and once it is cached.
+func TestTwoHandles(t *testing.T) {
+	sub := bigSubject()
+	want := sub.Items[0].Content
+	startFake(t, sub)
+	root := testFS(t)
+	dir := mountFS(t, root)
+	file := filepath.Join(dir, "Redes", "video.mp4")
+
+	for _, cached := range []bool{false, true} {
+		if cached {
+			// downloaded by the streaming handles
+			it := root.lookupItem("/Redes/video.mp4")
+			if it == nil || !root.cache.hit(it.key()) {
+				t.Fatal("not cached after reading it")
+			}
+		}
+		f1, err := open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2, err := open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4096)
+		if _, err := f1.ReadAt(buf, chunkSize); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, want[chunkSize:chunkSize+len(buf)]) {
+			t.Errorf("cached %v: first handle read wrong bytes", cached)
+		}
+		if err := f1.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadAll(f2)
+		f2.Close()
+		if err != nil {
+			t.Fatalf("cached %v: %s", cached, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("cached %v: second handle read %d bytes, want %d", cached, len(got), len(want))
+		}
+		unpinned(t, root)
+	}
+}
+
+// readFile reads the file at name using open
+func readFile(name string) ([]byte, error) {
+	f, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// names lists the folder at name
+func names(t *testing.T, name string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []string
+	for _, f := range files {
+		s = append(s, f.Name())
+	}
+	return s
+}
+
+func TestLookup(t *testing.T) {
+	startFake(t, testSubjects()...)
+	dir := mountFS(t, testFS(t))
+
+	for _, p := range []string{
+		"Cálculo",
+		"FUNDAMENTOS DE LOS COMPUTADORES/Prácticas/p1.txt",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, p)); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, p := range []string{
+		"Física",
+		"Cálculo/apuntes.pdf",
+		"FUNDAMENTOS DE LOS COMPUTADORES/Prácticas/p2.txt",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, p)); !errors.Is(err, syscall.ENOENT) {
+			t.Errorf("%s: got %v, want ENOENT", p, err)
+		}
+	}
+}
+
+func TestReadDirAll(t *testing.T) {
+	startFake(t, testSubjects()...)
+	dir := mountFS(t, testFS(t))
+
+	for p, want := range map[string][]string{
+		"":                                {"Cálculo", "FUNDAMENTOS DE LOS COMPUTADORES"},
+		"FUNDAMENTOS DE LOS COMPUTADORES": {"Prácticas", "Tema 1.pdf"},
+		"FUNDAMENTOS DE LOS COMPUTADORES/Prácticas": {"p1.txt"},
+		"Cálculo": {"apuntes.txt"},
+	} {
+		if got := names(t, filepath.Join(dir, p)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, want %q", p, got, want)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	startFake(t, testSubjects()...)
+	root := testFS(t)
+	dir := mountFS(t, root)
+
+	for p, want := range map[string]string{
+		"FUNDAMENTOS DE LOS COMPUTADORES/Tema 1.pdf":       "contenido del tema 1",
+		"FUNDAMENTOS DE LOS COMPUTADORES/Prácticas/p1.txt": "práctica 1\n",
+		"Cálculo/apuntes.txt":                              "derivadas",
+	} {
+		// the second time it is cached
+		for i := 0; i < 2; i++ {
+			got, err := readFile(filepath.Join(dir, p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("%s: got %q, want %q", p, got, want)
+			}
+		}
+	}
+	unpinned(t, root)
+}
+
+func TestAttr(t *testing.T) {
+	startFake(t, testSubjects()...)
+	dir := mountFS(t, testFS(t))
+	date := time.Date(2018, 3, 2, 10, 20, 0, 0, uaLocation)
+
+	for p, want := range map[string]struct {
+		size int64
+		mode os.FileMode
+	}{
+		"FUNDAMENTOS DE LOS COMPUTADORES/Tema 1.pdf": {20, 0644},
+		"FUNDAMENTOS DE LOS COMPUTADORES/Prácticas":  {0, os.ModeDir | 0555},
+		// not listed: probed
+		"Cálculo/apuntes.txt": {9, 0644},
+	} {
+		st, err := os.Stat(filepath.Join(dir, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode() != want.mode {
+			t.Errorf("%s: mode %s, want %s", p, st.Mode(), want.mode)
+		}
+		if !st.IsDir() && st.Size() != want.size {
+			t.Errorf("%s: size %d, want %d", p, st.Size(), want.size)
+		}
+		if !st.ModTime().Equal(date) {
+			t.Errorf("%s: mtime %s, want %s", p, st.ModTime(), date)
+		}
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	sub := bigSubject()
+	want := sub.Items[0].Content
+	startFake(t, sub)
+	root := testFS(t)
+	file := filepath.Join(mountFS(t, root), "Redes", "video.mp4")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := open(file)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer f.Close()
+			// readers start at different chunks
+			off := int64(i%3) * chunkSize
+			got := make([]byte, len(want)-int(off))
+			if _, err := f.ReadAt(got, off); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, want[off:]) {
+				errs <- fmt.Errorf("reader %d read wrong bytes at %d", i, off)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	unpinned(t, root)
+	if it := root.lookupItem("/Redes/video.mp4"); it == nil || !root.cache.hit(it.key()) {
+		t.Error("not cached after reading it")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	defer func(ttl time.Duration) { *dirTTL = ttl }(*dirTTL)
+	*dirTTL = 0
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	dir := mountFS(t, root)
+	folder := filepath.Join(dir, "FUNDAMENTOS DE LOS COMPUTADORES", "Prácticas")
+	if got := names(t, folder); !reflect.DeepEqual(got, []string{"p1.txt"}) {
+		t.Fatalf("got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "p1.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// folders are fetched again when they are used after -ttl
+	srv.Update(func() {
+		srv.Subjects[0].Items[1].Items = []*fakeua.Item{
+			{ID: "1004", Name: "p2.txt", Content: []byte("práctica 2\n")},
+		}
+	})
+	if got := names(t, folder); !reflect.DeepEqual(got, []string{"p2.txt"}) {
+		t.Errorf("got %q, want the new material", got)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "p1.txt")); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("removed material: got %v, want ENOENT", err)
+	}
+	if got, err := readFile(filepath.Join(folder, "p2.txt")); err != nil || string(got) != "práctica 2\n" {
+		t.Errorf("new material: got %q, %v", got, err)
+	}
+
+	// subjects are fetched again by refresh
+	srv.Update(func() {
+		srv.Subjects = srv.Subjects[:1]
+	})
+	if err := root.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, dir); !reflect.DeepEqual(got, []string{"FUNDAMENTOS DE LOS COMPUTADORES"}) {
+		t.Errorf("got %q, want the remaining subject", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Cálculo")); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("removed subject: got %v, want ENOENT", err)
+	}
+}
+
+func TestErrno(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	dir := mountFS(t, testFS(t))
+	subject := filepath.Join(dir, "FUNDAMENTOS DE LOS COMPUTADORES")
+	names(t, subject)
+
+	// folders never listed fail
+	srv.Fail(fakeua.FilesPath, 403)
+	if _, err := ioutil.ReadDir(filepath.Join(subject, "Prácticas")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("listing: got %v, want EACCES", err)
+	}
+	srv.Fail(fakeua.DownloadPath, 403)
+	if _, err := readFile(filepath.Join(subject, "Tema 1.pdf")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("download: got %v, want EACCES", err)
+	}
+	srv.Fail(fakeua.DownloadPath, 404)
+	if _, err := readFile(filepath.Join(subject, "Prácticas", "p1.txt")); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("download: got %v, want ENOENT", err)
+	}
+}
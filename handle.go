@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+// handle is an opened File.
+//
+// Every Open returns its own handle holding its own cache file
+// and its own pin (or transfer reference), so releasing
+// one handle never affects the others.
+type handle struct {
+	*File
+	// cache key of the file
+	key  string
+	file afero.File
+	// used instead of file while downloading
+	stream *transfer
+}
+
+// touch marks cached file as recently used
+func (h *handle) touch() {
+	h.Root.cache.touch(h.key)
+}
+
+var _ fs.HandleReader = (*handle)(nil)
+
+// Read reads file contents
+func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer h.touch()
+	var n int
+	switch {
+	case h.stream != nil:
+		n, err = h.stream.read(ctx, resp.Data[:req.Size], req.Offset)
+	case h.file != nil:
+		n, err = h.file.ReadAt(resp.Data[:req.Size], req.Offset)
+	default:
+		err = fuse.ENOTSUP
+		goto end
+	}
+	resp.Data = resp.Data[:n]
+end:
+	if err == io.EOF {
+		err = nil
+	}
+	return toErrno(err)
+}
+
+var _ fs.HandleReleaser = (*handle)(nil)
+
+// Release closes handle file
+func (h *handle) Release(_ context.Context, req *fuse.ReleaseRequest) error {
+	h.touch()
+	if h.stream != nil {
+		h.stream.release()
+		h.stream = nil
+		return nil
+	}
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+		h.Root.cache.unpin(h.key)
+	}
+	return nil
+}
+
+var _ fs.HandleWriter = (*handle)(nil)
+
+// Write writes in a file
+func (h *handle) Write(_ context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer h.touch()
+	var n int
+	if h.file == nil {
+		err = fuse.ENOTSUP
+		goto end
+	}
+	n, err = h.file.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+end:
+	return err
+}
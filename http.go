@@ -2,23 +2,230 @@ package main
 
 import (
 	"bytes"
-	"fmt"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/erikdubbelboer/fasthttp"
 	"github.com/themester/fcookiejar"
+	"golang.org/x/net/context"
 )
 
-func doReqFollowRedirects(
+const (
+	// attempts of every request
+	maxRetries = 4
+	// backoff doubles from backoffMin to backoffMax
+	backoffMin = 500 * time.Millisecond
+	backoffMax = 10 * time.Second
+	// max redirects followed
+	maxRedirects = 10
+)
+
+// doReqFollowRedirects performs req following redirects.
+// Network errors, 5xx and 429 responses are retried
+// waiting an exponential backoff with jitter.
+//
+// It returns ctx error as soon as ctx is done, but a request
+// being sent is only aborted by its deadline (see -timeout)
+// unless ctx is abortable.
+func doReqFollowRedirects(ctx context.Context,
+	req *fasthttp.Request, res *fasthttp.Response,
+	client *fasthttp.Client, cookies *cookiejar.CookieJar) (err error) {
+
+	orig := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(orig)
+	// redirects modify req
+	req.CopyTo(orig)
+	skip := res.SkipBody
+
+	for i := 1; ; i++ {
+		err = doReq(ctx, req, res, client, cookies)
+		var ue *uaError
+		if err == nil || !errors.As(err, &ue) || !ue.temporary() || i == maxRetries {
+			break
+		}
+		wait := backoff(i)
+		if ue.kind == kindRateLimited {
+			// Retry-After in seconds
+			if s, perr := strconv.Atoi(string(res.Header.Peek("Retry-After"))); perr == nil && s > 0 {
+				wait = time.Duration(s) * time.Second
+				if wait > backoffMax {
+					wait = backoffMax
+				}
+			}
+		}
+		log.Printf("%s: %s. Retrying in %s", orig.URI(), err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		orig.CopyTo(req)
+		res.Reset()
+		res.SkipBody = skip
+	}
+	return err
+}
+
+// backoff returns the time to wait before the attempt n+1
+func backoff(n int) time.Duration {
+	d := backoffMin << uint(n-1)
+	if d > backoffMax || d <= 0 {
+		d = backoffMax
+	}
+	// full jitter over the second half
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// abortKey marks contexts of abortable requests (see abortable)
+type abortKey struct{}
+
+// abortable returns a context whose requests are aborted when
+// it is done instead of running until -timeout (see doAbortable).
+// They do not reuse connections, so it is meant for transfers.
+func abortable(ctx context.Context) context.Context {
+	return context.WithValue(ctx, abortKey{}, true)
+}
+
+// doDeadline performs req until ctx deadline or -timeout
+func doDeadline(ctx context.Context, req *fasthttp.Request, res *fasthttp.Response, client *fasthttp.Client) error {
+	deadline, ok := ctx.Deadline()
+	if *timeout > 0 {
+		if d := time.Now().Add(*timeout); !ok || d.Before(deadline) {
+			deadline, ok = d, true
+		}
+	}
+	if ctx.Value(abortKey{}) != nil {
+		return doAbortable(ctx, req, res, client, deadline)
+	}
+	if !ok {
+		return client.Do(req, res)
+	}
+	// the request goes on after the deadline in the background
+	return client.DoDeadline(req, res, deadline)
+}
+
+// doAbortable performs req using a connection of its own which is
+// closed when ctx is done or at deadline (if not zero), so the transfer
+// stops at once. Pooled connections cannot be told apart.
+func doAbortable(ctx context.Context, req *fasthttp.Request, res *fasthttp.Response,
+	client *fasthttp.Client, deadline time.Time) error {
+
+	uri := req.URI()
+	isTLS := bytes.Equal(uri.Scheme(), []byte("https"))
+	addr := string(uri.Host())
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "80"
+		if isTLS {
+			port = "443"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+
+	var mu sync.Mutex
+	var conn net.Conn
+	// the connection must be closed
+	aborted := false
+	dialer := client.Dial
+	if dialer == nil {
+		dialer = fasthttp.Dial
+	}
+	hc := &fasthttp.HostClient{
+		Addr:                addr,
+		IsTLS:               isTLS,
+		TLSConfig:           client.TLSConfig,
+		Name:                client.Name,
+		MaxResponseBodySize: client.MaxResponseBodySize,
+		// retried by doReqFollowRedirects
+		MaxIdemponentCallAttempts: 1,
+		Dial: func(addr string) (net.Conn, error) {
+			c, err := dialer(addr)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if aborted {
+				c.Close()
+				return nil, fasthttp.ErrConnectionClosed
+			}
+			conn = c
+			return c, nil
+		},
+	}
+	abort := func() {
+		mu.Lock()
+		aborted = true
+		if conn != nil {
+			conn.Close()
+		}
+		mu.Unlock()
+	}
+	// not kept idle by hc
+	req.SetConnectionClose()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	timedOut := make(chan bool, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			abort()
+		case <-expired:
+			timedOut <- true
+			abort()
+		case <-done:
+		}
+	}()
+
+	err := hc.Do(req, res)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	select {
+	case <-timedOut:
+		return fasthttp.ErrTimeout
+	default:
+	}
+	return err
+}
+
+// doReq performs req once following redirects.
+//
+// Requests to UACloud redirected through the CAS login return
+// errExpired: even if CAS sends us back (its ticket is still valid)
+// the request has been replaced by a GET of the redirect.
+func doReq(ctx context.Context,
 	req *fasthttp.Request, res *fasthttp.Response,
 	client *fasthttp.Client, cookies *cookiejar.CookieJar) (err error) {
 
 	var url, body []byte
 	var status int
 	var referer string
-	for {
+	skip := res.SkipBody
+	// logins are expected to go through CAS
+	toCAS := endpoints.isCAS(string(req.URI().Host()), string(req.URI().Path()))
+	viaCAS := false
+	for redirects := 0; ; redirects++ {
 		// use compression!!!11!
 		// compression is better. Compress your life :')
-		req.Header.Add("Accept-Encoding", "gzip")
+		if len(req.Header.Peek("Accept-Encoding")) == 0 {
+			req.Header.Add("Accept-Encoding", "gzip")
+		}
 
 		if referer != "" {
 			req.Header.Add("Referer", referer)
@@ -26,44 +233,66 @@ func doReqFollowRedirects(
 		// writting cookies to request
 		cookies.AddToRequest(req)
 
-		err = client.Do(req, res)
+		err = ctx.Err()
+		if err != nil {
+			goto end
+		}
+		err = doDeadline(ctx, req, res, client)
 		if err != nil {
+			if ctx.Err() != nil {
+				// aborted (see abortable)
+				err = ctx.Err()
+			} else {
+				err = &uaError{kind: kindNetwork, err: err}
+			}
 			goto end
 		}
 		// reading cookies from the response
 		cookies.ResponseCookies(res)
 
 		status = res.Header.StatusCode()
+		debugf("%s %s: %d", req.Header.Method(), req.URI(), status)
 		if status < 300 || status > 399 { // no redirect
 			break
 		}
 		referer, url = string(url), res.Header.Peek("Location")
-		if len(url) == 0 {
-			err = fmt.Errorf("Status code is redirect (%d) but no one location have been provided", status)
+		if len(url) == 0 || redirects == maxRedirects {
+			err = &uaError{
+				kind:   kindServer,
+				status: status,
+				err:    errors.New("bad redirect"),
+			}
 			goto end
 		}
 		req.Reset()
 		res.Reset()
+		res.SkipBody = skip
 
 		req.SetRequestURIBytes(url)
+		if !toCAS && endpoints.isCAS(string(req.URI().Host()), string(req.URI().Path())) {
+			viaCAS = true
+		}
 	}
-	switch status {
-	case fasthttp.StatusOK:
-	case fasthttp.StatusUnauthorized:
-		err = fmt.Errorf("Incorrect password")
+	if viaCAS {
+		err = errExpired
 		goto end
+	}
+	switch status {
+	case fasthttp.StatusOK, fasthttp.StatusPartialContent:
 	default:
-		err = fmt.Errorf("error server returned status code %d", status)
+		err = statusError(status)
 		goto end
 	}
 	body = res.Body()
-	if bytes.Equal(res.Header.Peek("Content-Encoding"), []byte("gzip")) {
+	if len(body) > 0 && bytes.Equal(res.Header.Peek("Content-Encoding"), []byte("gzip")) {
 		// gunzipping
-		_, err = fasthttp.AppendGunzipBytes(body, body)
+		body, err = fasthttp.AppendGunzipBytes(nil, body)
 		if err != nil {
-			panic(err)
+			err = &uaError{kind: kindDecode, err: err}
+			goto end
 		}
 		res.SetBody(body)
+		res.Header.Del("Content-Encoding")
 	}
 end:
 	return err
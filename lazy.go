@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// folders are fetched when they are first listed (see load)
+	dirTTL = flag.Duration("ttl", 5*time.Minute, "How long folder listings are cached")
+	// traffic is not proportional to browsing anymore
+	prefetch = flag.Bool("prefetch", false, "Fetch subfolders and sibling folders of listed folders in the background")
+)
+
+// loadCall is a folder being loaded
+type loadCall struct {
+	done chan struct{}
+	err  error
+}
+
+// refresh refreshes the list of subjects. Loaded folders are kept
+// and fetched again when they are used after -ttl (see load).
+func (root *FS) refresh() error {
+	items, err := root.getFolders(context.Background())
+	if err != nil {
+		log.Println("fetching folders:", err)
+	}
+	if !usable(items, err) {
+		return err
+	}
+	d, inv := root.merge(func(current []*uaitem) []*uaitem {
+		for _, subject := range items {
+			inherit(current, subject)
+		}
+		return keepSkipped(items, current, err)
+	})
+	root.invalidate(inv)
+	root.refreshed(d)
+	return err
+}
+
+// fresh reports whether items of the folder it can be used
+func (it *uaitem) fresh() bool {
+	return !it.loaded.IsZero() && time.Since(it.loaded) < *dirTTL
+}
+
+// load makes sure items of the folder at name are fetched and fresh.
+// The root is loaded by refresh. If ahead is set, subfolders and
+// sibling folders are loaded in the background after fetching
+// the folder (see prefetch).
+//
+// Concurrent loads of a folder share the request. If it fails,
+// expired items are kept and only folders never loaded fail.
+func (root *FS) load(ctx context.Context, name string, ahead bool) error {
+	if name == "/" {
+		return nil
+	}
+	root.Lock()
+	dir := lookup(root.items, name)
+	if dir == nil || !dir.folder || dir.fresh() {
+		root.Unlock()
+		return nil
+	}
+	c, ok := root.loading[name]
+	if !ok {
+		c = &loadCall{
+			done: make(chan struct{}),
+		}
+		root.loading[name] = c
+		// not canceled with the request: others can be waiting
+		go root.fetchFolder(c, dir, ahead)
+	}
+	loaded := !dir.loaded.IsZero()
+	root.Unlock()
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if c.err != nil && loaded {
+		log.Printf("fetching %s: %s", name, c.err)
+		return nil
+	}
+	return c.err
+}
+
+// fetchFolder fetches items of dir replacing it in the tree
+func (root *FS) fetchFolder(c *loadCall, dir *uaitem, ahead bool) {
+	name := dir.fullpath()
+	items, err := root.getFolder(context.Background(), dir, dir)
+	if usable(items, err) {
+		var inv *invalidation
+		_, inv = root.merge(func(current []*uaitem) []*uaitem {
+			return replace(current, name, func(old *uaitem) *uaitem {
+				// loaded subfolders keep their items
+				for _, it := range items {
+					if it.folder {
+						inherit(old.items, it)
+					}
+				}
+				it := *old
+				it.items, it.loaded = keepSkipped(items, old.items, err), time.Now()
+				return &it
+			})
+		})
+		// nothing cached by the kernel before the first load.
+		// Otherwise it can be waiting for the request loading dir
+		if !dir.loaded.IsZero() {
+			go root.invalidate(inv)
+		}
+		if ahead {
+			go root.prefetch(name, items)
+		}
+	}
+
+	if err != nil && usable(items, err) {
+		// malformed rows are skipped (see keepSkipped)
+		log.Printf("fetching %s: %s", name, err)
+		err = nil
+	}
+	root.Lock()
+	delete(root.loading, name)
+	root.Unlock()
+	c.err = err
+	close(c.done)
+}
+
+// prefetch loads the folders likely to be listed after the one
+// at name: its subfolders (items) and then its siblings.
+// They are loaded one by one without going deeper.
+func (root *FS) prefetch(name string, items []*uaitem) {
+	root.RLock()
+	siblings := root.items
+	if parent := lookup(root.items, path.Dir(name)); parent != nil {
+		siblings = parent.items
+	}
+	root.RUnlock()
+	for _, list := range [][]*uaitem{items, siblings} {
+		for _, it := range list {
+			if it.folder && it.fullpath() != name {
+				root.load(context.Background(), it.fullpath(), false)
+			}
+		}
+	}
+}
+
+// replace returns a copy of items where the folder at name
+// is replaced by the result of fn. Folders containing it are
+// copied too, so items are never modified.
+func replace(items []*uaitem, name string, fn func(*uaitem) *uaitem) []*uaitem {
+	for i, it := range items {
+		if !it.folder {
+			continue
+		}
+		var repl *uaitem
+		switch {
+		case it.path == name:
+			repl = fn(it)
+		case strings.HasPrefix(name, it.path+"/"):
+			c := *it
+			c.items = replace(it.items, name, fn)
+			repl = &c
+		default:
+			continue
+		}
+		cp := make([]*uaitem, len(items))
+		copy(cp, items)
+		cp[i] = repl
+		return cp
+	}
+	// removed while it was fetched
+	return items
+}
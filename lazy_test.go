@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LibreLABUA/uafs/fakeua"
+	"golang.org/x/net/context"
+)
+
+// loaded returns the folder at name and whether it has been loaded
+func loaded(root *FS, name string) (*uaitem, bool) {
+	root.RLock()
+	defer root.RUnlock()
+	it := lookup(root.items, name)
+	return it, it != nil && !it.loaded.IsZero()
+}
+
+func TestLoadTTL(t *testing.T) {
+	defer func(ttl time.Duration) { *dirTTL = ttl }(*dirTTL)
+	*dirTTL = time.Hour
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	if err := root.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	const subject = "/FUNDAMENTOS DE LOS COMPUTADORES"
+	if _, ok := loaded(root, subject); ok {
+		t.Fatal("folder loaded before being used")
+	}
+	if n := srv.Requests(fakeua.FilesPath); n != 0 {
+		t.Fatalf("%d folders fetched by refresh", n)
+	}
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		ttl time.Duration
+		// requests after loading
+		requests int
+	}{
+		{time.Hour, 1},
+		// fresh
+		{time.Hour, 1},
+		// expired
+		{0, 2},
+		{0, 3},
+	} {
+		*dirTTL = tt.ttl
+		if err := root.load(ctx, subject, false); err != nil {
+			t.Fatal(err)
+		}
+		if n := srv.Requests(fakeua.FilesPath); n != tt.requests {
+			t.Errorf("ttl %s: got %d requests, want %d", tt.ttl, n, tt.requests)
+		}
+	}
+	it, ok := loaded(root, subject)
+	if !ok || len(it.items) != 2 {
+		t.Fatalf("got %d items, want 2", len(it.items))
+	}
+	// subfolders are not loaded
+	if _, ok := loaded(root, subject+"/Prácticas"); ok {
+		t.Error("subfolder loaded")
+	}
+
+	// expired items are kept if the folder cannot be fetched
+	srv.Fail(fakeua.FilesPath, 404, 404)
+	if err := root.load(ctx, subject, false); err != nil {
+		t.Errorf("expired folder: got %v", err)
+	}
+	if it, _ := loaded(root, subject); len(it.items) != 2 {
+		t.Errorf("expired folder: got %d items, want 2", len(it.items))
+	}
+	// folders never loaded fail
+	if err := root.load(ctx, subject+"/Prácticas", false); !errors.Is(err, errNotFound) {
+		t.Errorf("new folder: got %v, want %v", err, errNotFound)
+	}
+}
+
+func TestLoadShared(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	if err := root.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	const subject = "/Cálculo"
+
+	release := srv.Stall(fakeua.FilesPath, 1)
+	defer release()
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = root.load(context.Background(), subject, false)
+		}(i)
+	}
+	// a canceled load does not cancel the others
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := root.load(ctx, subject, false); err != context.Canceled {
+		t.Errorf("canceled load: got %v", err)
+	}
+	for srv.Requests(fakeua.FilesPath) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := srv.Requests(fakeua.FilesPath); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+	if _, ok := loaded(root, subject); !ok {
+		t.Error("folder not loaded")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	subjects := testSubjects()
+	subjects[1].Items = append(subjects[1].Items, &fakeua.Item{
+		ID: "2002", Name: "Ejercicios", Folder: true,
+	})
+	srv := startFake(t, subjects...)
+	root := testFS(t)
+	if err := root.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	const subject = "/FUNDAMENTOS DE LOS COMPUTADORES"
+	if err := root.load(context.Background(), subject, true); err != nil {
+		t.Fatal(err)
+	}
+	// subfolders and siblings
+	want := []string{subject + "/Prácticas", "/Cálculo"}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		_, a := loaded(root, want[0])
+		_, b := loaded(root, want[1])
+		if a && b {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v %v, want %s loaded", a, b, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// without going deeper
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := loaded(root, "/Cálculo/Ejercicios"); ok {
+		t.Error("subfolder of a sibling prefetched")
+	}
+	if n := srv.Requests(fakeua.FilesPath); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"fmt"
+	"errors"
+	"log"
 	"regexp"
 
 	"github.com/erikdubbelboer/fasthttp"
 	"github.com/themester/fcookiejar"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -14,70 +16,84 @@ var (
 	regexep = regexp.MustCompile(`name="execution"\svalue="(.*?)"`)
 )
 
-func login(user, pass string) (*fasthttp.Client, *cookiejar.CookieJar, error) {
-	client := &fasthttp.Client{
+// dial connects to UACloud. nil means TCP.
+// It allows using an in-memory server (see fakeua).
+var dial fasthttp.DialFunc
+
+func newClient() *fasthttp.Client {
+	return &fasthttp.Client{
+		Dial: dial,
 		// nice user agent you can choose whatever you want ex: Jomoza sube minecraft
 		Name:                "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/66.0.3359.181 Safari/537.36",
 		MaxResponseBodySize: MB * 100, // 100 mb of download files
 	}
+}
+
+// login performs CAS login and saves the session (see session.go)
+func login(ctx context.Context, user string, pass *secret) (*fasthttp.Client, *cookiejar.CookieJar, error) {
+	client := newClient()
+	// creating cookieJar object
+	cookies := cookiejar.AcquireCookieJar()
+
+	// getting request, response and arguments for post request
+	args := fasthttp.AcquireArgs()
+	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseArgs(args)
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
 
 	// Be patient... UA's webpage is written in C#
-	status, body, err := client.Get(nil, urlNormal)
+	req.SetRequestURI(endpoints.loginURL())
+	err := doReqFollowRedirects(ctx, req, res, client, cookies)
 	if err != nil {
+		cookiejar.ReleaseCookieJar(cookies)
 		return nil, nil, err
 	}
-	if status != 200 {
-		return nil, nil, fmt.Errorf("Unexpected response code: %d<>200", status)
-	}
 
 	// getting execution parameter
-	execp := regexep.FindSubmatch(body)
+	execp := regexep.FindSubmatch(res.Body())
 	if len(execp) == 0 {
-		return nil, nil, fmt.Errorf("error getting login parameters...")
+		cookiejar.ReleaseCookieJar(cookies)
+		return nil, nil, &uaError{
+			kind: kindDecode,
+			err:  errors.New("login parameters not found"),
+		}
 	}
 
-	// reusing body as much as possible
 	// submatch is the latest parameter so we take len-1
-	body = append(body[:0], execp[len(execp)-1]...)
-
-	// getting request, response and arguments for post request
-	args := fasthttp.AcquireArgs()
-	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseArgs(args)
-	defer fasthttp.ReleaseRequest(req)
-	defer fasthttp.ReleaseResponse(res)
+	execution := append([]byte(nil), execp[len(execp)-1]...)
+	req.Reset()
+	res.Reset()
 
 	req.Header.SetContentType("application/x-www-form-urlencoded")
 	req.Header.SetMethod("POST")
 
-	req.SetRequestURI(urlLogin)
+	req.SetRequestURI(endpoints.loginURL())
 
 	// setting parameters for post request
 	args.Set("_eventId", "submit")
 	args.Set("username", user)
-	args.Set("password", pass)
+	args.SetBytesV("password", pass.Bytes())
 	args.Set("geolocation", "")
-	args.SetBytesV("execution", body)
+	args.SetBytesV("execution", execution)
 
 	// writting post arguments to request body
 	args.WriteTo(req.BodyWriter())
 
-	// creating cookieJar object
-	cookies := cookiejar.AcquireCookieJar()
-
 	// make requests xd
-	err = doReqFollowRedirects(req, res, client, cookies)
+	err = doReqFollowRedirects(ctx, req, res, client, cookies)
+	// CAS answers 401 or the login form again if password is incorrect
+	if err == nil && regexep.Match(res.Body()) {
+		err = errAuthFailed
+	}
 	if err != nil {
+		cookiejar.ReleaseCookieJar(cookies)
 		return nil, nil, err
 	}
 
-	// getting new cookies
-	cookies.ResponseCookies(res)
-
-	// 401 code if password is incorrect
-	if status == 401 {
-		err = fmt.Errorf("Incorrect password")
+	// a session that cannot be saved just will not be reused
+	if err := saveSession(user, cookies); err != nil {
+		log.Println("saving session:", err)
 	}
-
-	return client, cookies, err
+	return client, cookies, nil
 }
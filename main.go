@@ -5,187 +5,329 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path"
-	"strings"
 	"sync"
+	"syscall"
 	"time"
-	"unsafe"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"github.com/erikdubbelboer/fasthttp"
-	"github.com/howeyc/gopass"
 	"github.com/marcsantiago/gocron"
-	"github.com/sevlyar/go-daemon"
 	"github.com/spf13/afero"
-	"github.com/themester/fcookiejar"
-	"github.com/valyala/fastrand"
+	"golang.org/x/net/context"
 )
 
-// max cache files
 var (
-	maxFiles    = flag.Int("n", 5, "Max files")
 	cacheUpdate = flag.Uint64("u", 2, "Cache update time")
+	cacheDir    = flag.String("c", "", "Cache directory (default ~/.cache/uafs/<username>)")
+	// least recently used files are evicted when the budget is exceeded
+	cacheSize = flag.Int64("s", 1024, "Cache budget in MB (0 means unlimited)")
+	// some tools do not like non-ASCII paths
+	asciiNames = flag.Bool("ascii", false, "Transliterate file names to ASCII")
+	// password sources (see getSecret)
+	passCmd = flag.String("pass-cmd", os.Getenv("UAFS_PASS_CMD"), "Command printing the password (ex: pass show ua)")
+	// deadline of every HTTP request to UACloud
+	timeout = flag.Duration("timeout", time.Minute, "Timeout of UACloud requests (0 means none)")
+	keyring = flag.Bool("keyring", os.Getenv("UAFS_KEYRING") != "", "Get the password and the session key from the Secret Service (secret-tool)")
+	// backend (see loadConfig)
+	configPath = flag.String("config", os.Getenv("UAFS_CONFIG"), "Config file (default ~/.config/uafs/config.json)")
+	uacloudURL = flag.String("uacloud", os.Getenv("UAFS_UACLOUD"), "UACloud base URL (ex: http://localhost:8080)")
+	casURL     = flag.String("cas", os.Getenv("UAFS_CAS"), "CAS server URL (ex: https://autentica.cpd.ua.es/cas)")
+	serviceURL = flag.String("service", "", "CAS service URL")
 )
 
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Printf("%s <username>@alu.ua.es <mount point>\n", os.Args[0])
-		os.Exit(0)
-	}
-	// TODO: key daemon process
-	pass := os.Getenv("psswrd")
-	if pass == "" {
-		fmt.Printf("Password: ")
-		p, err := gopass.GetPasswd()
+	cmd, args, err := parseCommand(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+	if !cmd.takes(len(args)) {
+		cmd.usage()
+		os.Exit(2)
+	}
+	if *foreground || cmd != mountCmd {
+		err = setupLog("")
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		pass = b2s(p)
 	}
-	if !strings.Contains(os.Args[1], "@alu") {
-		os.Args[1] += "@alu.ua.es"
+	err = loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(1)
 	}
 
-	// logging in
-	client, cookies, err := login(
-		os.Args[1], pass,
-	)
+	err = cmd.run(args)
 	if err != nil {
-		// bad password or client error
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	os.Unsetenv("psswrd")
+}
 
-	// invoking daemon
-	ctx := daemon.Context{
-		Env:         append(os.Environ(), "psswrd="+pass),
-		LogFileName: path.Join(os.TempDir(), "uafs.log"),
+// connect returns a UACloud session of user reusing the saved one
+// if UACloud still accepts it. Otherwise pass is used to log in,
+// asking for it if it is empty. The password used is returned.
+func connect(user string, pass *secret) (*uaclient, *secret, error) {
+	client, cookies, err := resume(context.Background(), user)
+	if err == nil {
+		return newUAClient(user, pass, client, cookies), pass, nil
 	}
-	dmn, err := ctx.Reborn()
+	debugf("saved session not used: %s", err)
+	if pass.Empty() {
+		pass, err = getSecret(user)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	client, cookies, err = login(context.Background(), user, pass)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, pass, err
+	}
+	return newUAClient(user, pass, client, cookies), pass, nil
+}
+
+// openUserCache opens the cache of user (see -c)
+func openUserCache(user string) (*diskCache, error) {
+	dir := *cacheDir
+	if dir == "" {
+		var err error
+		dir, err = os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = path.Join(dir, "uafs", user)
 	}
-	if dmn != nil { // parent
-		return
+	return openCache(dir, *cacheSize*1024*1024)
+}
+
+// runMount mounts UACloud in background
+// (or in foreground using -f).
+func runMount(args []string) error {
+	user, mnt := username(args[0]), args[1]
+
+	// the daemon gets the password from its parent
+	var pass *secret
+	var err error
+	if isDaemon() {
+		pass, err = inheritedSecret()
+		if err != nil {
+			return err
+		}
+	}
+	defer func() {
+		pass.Wipe()
+	}()
+
+	// reusing saved session if UACloud still accepts it
+	ua, pass, err := connect(user, pass)
+	if err != nil {
+		// bad password or client error
+		return err
 	}
-	defer dmn.Release()
 
+	// invoking daemon
+	if !*foreground && !isDaemon() {
+		file := *logFile
+		if file == "" {
+			file = defaultLogFile()
+		}
+		return daemonize(file, pass)
+	}
+	return mount(user, mnt, ua)
+}
+
+// mount serves the filesystem of session ua on mnt until it is
+// unmounted (or SIGINT or SIGTERM are received). mnt is created
+// if it does not exist and removed after unmounting.
+func mount(user, mnt string, ua *uaclient) error {
 	// stat of mount dir
 	created := false
-	if _, err := os.Stat(os.Args[2]); err != nil {
+	if _, err := os.Stat(mnt); err != nil {
+		err = os.Mkdir(mnt, 0755)
+		if err != nil {
+			return err
+		}
 		created = true
-		os.Mkdir(os.Args[2], 0755)
+	}
+	defer func() {
+		if created {
+			os.Remove(mnt)
+		}
+	}()
+
+	// opening persistent cache
+	cache, err := openUserCache(user)
+	if err != nil {
+		return err
 	}
 
 	// creating virtual filesystem
-	root := &FS{
-		Cookies: cookies,
-		Client:  client,
-		Name:    os.Args[1],
-		Pass:    pass,
-		Fs:      afero.NewMemMapFs(),
-		items:   make([]*uaitem, 0),
+	root := newFS(ua, cache)
+	// folders are fetched when they are listed (see load)
+	root.refresh()
+
+	// uafs status
+	ctl, err := serveControl(root, mnt)
+	if err != nil {
+		return err
 	}
-	root.fetch()
+	defer ctl.Close()
 
 	// mounting fuse system
 	fconn, err := fuse.Mount(
-		os.Args[2],
+		mnt,
 		fuse.FSName("uafs"),
 		fuse.Subtype("uafs"),
 		fuse.VolumeName("ua-volume"),
 	)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer fconn.Close()
+	log.Printf("%s mounted on %s", user, mnt)
 
-	// see checkFiles function
-	// checkFiles function will be done every 5 minutes
-	gocron.Every(*cacheUpdate).Minutes().Do(checkFiles, root)
+	// unmounting on SIGINT and SIGTERM
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		for sig := range sigs {
+			log.Printf("%s received. Unmounting %s", sig, mnt)
+			if err := fuse.Unmount(mnt); err != nil {
+				log.Println("unmount:", err)
+			}
+		}
+	}()
+
+	// refreshing UACloud subjects every cacheUpdate minutes
+	gocron.Every(*cacheUpdate).Minutes().Do(root.refresh)
+	stop := gocron.Start()
+	defer close(stop)
+	// kill -USR1 <pid> logs cache stats
+	go logStats(root)
 	// serve filesystem connections
-	err = fs.Serve(fconn, root)
+	root.server = fs.New(fconn, nil)
+	err = root.server.Serve(root)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	if created {
-		os.Remove(os.Args[2])
+	<-fconn.Ready
+	if err := fconn.MountError; err != nil {
+		return err
 	}
+	log.Printf("%s unmounted", mnt)
+	return nil
 }
 
-// checkFiles checks cache files
-// if file has not been modified in 20 minutes it will be deleted.
-func checkFiles(fs *FS) {
-	defer fs.fetch()
-	// using mutexes
-	fs.Lock()
-	// copying cache files
-	files := fs.downloadFiles
-	// resetting files
-	fs.downloadFiles = fs.downloadFiles[:0]
-	fs.Unlock()
-	for i := 0; i < len(files); i++ {
-		file := files[i]
-		st, err := fs.Fs.Stat(file)
-		if err != nil {
-			continue
-		}
-		// getting last modification time
-		if time.Since(st.ModTime()) > time.Minute*20 {
-			// removing
-			fs.Fs.Remove(file)
-			file, err := fs.Fs.Create(file)
-			if err == nil {
-				file.Close()
-			}
-			files = append(files[:i], files[i+1:]...)
-			i--
-		}
+// logStats logs cache stats every time SIGUSR1 is received
+func logStats(fs *FS) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		log.Println(fs.cache.Stats())
 	}
-	// unlocking and adding to cache slice
-	fs.Lock()
-	fs.downloadFiles = append(fs.downloadFiles, files...)
-	fs.Unlock()
 }
 
 // filesystem fuse structure
 var _ fs.FS = (*FS)(nil)
 
+// newFS returns an empty filesystem of the UACloud session ua
+// caching files in cache. Call fetch to fill it.
+//
+// It does not depend on flags or the mount, so FS can be served
+// on any fuse connection (ex: fstestutil.MountedT).
+func newFS(ua *uaclient, cache *diskCache) *FS {
+	tree := afero.NewMemMapFs()
+	tree.Mkdir("/", 0777)
+	return &FS{
+		ua:        ua,
+		Name:      ua.user,
+		Fs:        tree,
+		cache:     cache,
+		transfers: make(map[string]*transfer),
+		partials:  make(map[string]*partial),
+		items:     make([]*uaitem, 0),
+		names:     newNamer(),
+		facts:     newFacts(),
+		nodes:     make(map[string]fs.Node),
+		loading:   make(map[string]*loadCall),
+		limit:     newRateLimiter(*crawlRate),
+	}
+}
+
 type FS struct {
 	sync.RWMutex
-	// cache slice
-	downloadFiles []string
-	// UACloud cookies
-	Cookies *cookiejar.CookieJar
-	// UACloud client
-	Client *fasthttp.Client
-	Name   string
-	Pass   string
-	// Virtual in-memory filesystem
+	// persistent file cache
+	cache *diskCache
+	// downloads in progress
+	transfers map[string]*transfer
+	// interrupted downloads
+	partials map[string]*partial
+	// authenticated UACloud client
+	ua   *uaclient
+	Name string
+	// Virtual in-memory filesystem.
+	// Fs and items are guarded by the lock (see merge)
 	Fs afero.Fs
 	// downloaded items
 	items []*uaitem
+	// file names of items
+	names *namer
+	// sizes and content types of materials
+	facts *facts
+	// last refresh
+	fetched time.Time
+	// nodes given to the kernel by path (see invalidate)
+	nodes map[string]fs.Node
+	// used to invalidate kernel caches. nil if not mounted
+	server *fs.Server
+	// folders being loaded by path (see load)
+	loading map[string]*loadCall
+	// spaces folder requests (see getFolder)
+	limit *rateLimiter
 }
 
-func (root *FS) fetch() {
-	// getting UACloud folders
-	root.getFolders()
-	for i := range root.items {
-		root.getItems(root.items[i])
+// fetch refreshes all UACloud items returning the first error.
+// The current tree is kept if folders cannot be fetched.
+// If some subjects cannot be fetched the rest are refreshed
+// returning a *subjectsError.
+func (root *FS) fetch() error {
+	items, failed, err := root.crawl(context.Background())
+	if items == nil {
+		log.Println("fetching folders:", err)
+		return err
+	}
+	d, inv := root.merge(func(current []*uaitem) []*uaitem {
+		// subjects that cannot be fetched keep their items
+		for _, subject := range failed {
+			inherit(current, subject)
+		}
+		return keepSkipped(items, current, err)
+	})
+	root.invalidate(inv)
+	root.refreshed(d)
+	if len(failed) > 0 {
+		return &subjectsError{subjects: failed, err: err}
 	}
-	root.Fs.RemoveAll("/*")
-	root.Fs.Mkdir("/", 0777)
-	root.fill("/", root.items)
+	return err
+}
+
+// refreshed logs d and remembers the time of the refresh
+func (root *FS) refreshed(d treeDiff) {
+	if d.any() {
+		log.Println("refreshed:", d)
+	}
+	root.Lock()
+	root.fetched = time.Now()
+	root.Unlock()
 }
 
 // find item by name (path)
 func lookup(items []*uaitem, name string) *uaitem {
 	for _, item := range items {
-		if path.Join(item.path, item.name) == name {
+		if item.fullpath() == name {
 			return item
 		}
 		if i := lookup(item.items, name); i != nil {
@@ -195,31 +337,47 @@ func lookup(items []*uaitem, name string) *uaitem {
 	return nil
 }
 
-// fill fills fs.Fs using items
-func (fs *FS) fill(dir string, items []*uaitem) {
-	for _, item := range items {
-		filepath := path.Join(dir, item.name)
-		if item.folder {
-			fs.Fs.Mkdir(filepath, 0777)
-			fs.fill(filepath, item.items)
-		} else {
-			file, err := fs.Fs.Create(filepath)
-			if err == nil {
-				file.Close()
-			}
-		}
-	}
+func (root *FS) Root() (fs.Node, error) {
+	return root.node("/", true), nil
 }
 
-func (root *FS) Root() (fs.Node, error) {
-	return &Dir{
-		Root: root,
-		Name: "/",
-	}, nil
+// node returns the node at name creating it if needed.
+// The same node is returned while the kernel remembers it
+// so its caches can be invalidated.
+//
+// The item of a node is found when it is created and never
+// changes: changed paths get new nodes (see merge).
+func (root *FS) node(name string, dir bool) fs.Node {
+	root.Lock()
+	defer root.Unlock()
+	switch n := root.nodes[name].(type) {
+	case *Dir:
+		if dir {
+			return n
+		}
+	case *File:
+		if !dir {
+			return n
+		}
+	}
+	var n fs.Node
+	item := lookup(root.items, name)
+	if dir {
+		n = &Dir{Root: root, Name: name, item: item}
+	} else {
+		n = &File{Root: root, Name: name, item: item}
+	}
+	root.nodes[name] = n
+	return n
 }
 
-func b2s(b []byte) string {
-	return *(*string)(unsafe.Pointer(&b))
+// forget removes n from known nodes
+func (root *FS) forget(name string, n fs.Node) {
+	root.Lock()
+	if root.nodes[name] == n {
+		delete(root.nodes, name)
+	}
+	root.Unlock()
 }
 
 var (
@@ -227,14 +385,23 @@ var (
 	gid = os.Getgid()
 )
 
-func Info2Attr(info os.FileInfo, a *fuse.Attr) {
+// Info2Attr fills a using info and UACloud item metadata.
+// item can be nil.
+func Info2Attr(info os.FileInfo, item *uaitem, a *fuse.Attr) {
 	a.Inode = 0
-	if info.Size() == 0 {
-		a.Size = uint64(fastrand.Uint32n(uint32(999999)))
-	} else {
+	if item != nil {
+		a.Inode = item.inode()
+	}
+	switch {
+	case info.Size() != 0:
 		a.Size = uint64(info.Size())
+	case item != nil && item.size > 0:
+		a.Size = uint64(item.size)
 	}
 	a.Mtime = info.ModTime()
+	if item != nil && !item.date.IsZero() {
+		a.Mtime = item.date
+	}
 	a.Uid = uint32(uid)
 	a.Gid = uint32(gid)
 	if info.IsDir() {
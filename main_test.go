@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/LibreLABUA/uafs/fakeua"
+)
+
+func TestMain(m *testing.M) {
+	if isDaemon() {
+		os.Exit(daemonMain())
+	}
+	os.Exit(m.Run())
+}
+
+// user and password of the fake UACloud
+const (
+	testUser = "alumno@alu.ua.es"
+	testPass = "secreto"
+)
+
+// testSubjects returns the fixture tree used by tests
+func testSubjects() []*fakeua.Subject {
+	date := time.Date(2018, 3, 2, 10, 20, 0, 0, uaLocation)
+	return []*fakeua.Subject{{
+		Code: "34012",
+		Name: "FUNDAMENTOS DE LOS COMPUTADORES",
+		Items: []*fakeua.Item{
+			{ID: "1001", Name: "Tema 1.pdf", Date: date, Content: []byte("contenido del tema 1")},
+			{ID: "1002", Name: "Prácticas", Date: date, Folder: true, Items: []*fakeua.Item{
+				{ID: "1003", Name: "p1.txt", Date: date, Content: []byte("práctica 1\n")},
+			}},
+		},
+	}, {
+		Code: "34013",
+		Name: "Cálculo",
+		Items: []*fakeua.Item{
+			{ID: "2001", Name: "apuntes.txt", Date: date, Content: []byte("derivadas"), HideSize: true},
+		},
+	}}
+}
+
+// withPassword makes commands get the password from -pass-cmd command
+func withPassword(t *testing.T, command string) {
+	t.Helper()
+	old := *passCmd
+	t.Cleanup(func() { *passCmd = old })
+	*passCmd = command
+}
+
+// startFake starts a fake UACloud serving subjects and points uafs to it.
+// Sessions and caches are kept in temporary directories.
+func startFake(t *testing.T, subjects ...*fakeua.Subject) *fakeua.Server {
+	t.Helper()
+	srv := fakeua.New(map[string]string{testUser: testPass}, subjects...)
+	srv.Start()
+	oldDial, oldEndpoints := dial, endpoints
+	t.Cleanup(func() {
+		dial, endpoints = oldDial, oldEndpoints
+		srv.Close()
+	})
+	dial = srv.Dial
+	if err := endpoints.rebase(fakeua.URL); err != nil {
+		t.Fatal(err)
+	}
+	endpoints.CAS = fakeua.URL + fakeua.CASPath
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	return srv
+}
+
+// testFS returns the filesystem of a new session with the fake UACloud
+func testFS(t *testing.T) *FS {
+	t.Helper()
+	ua, _, err := connect(testUser, newSecret([]byte(testPass)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := openUserCache(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newFS(ua, cache)
+}
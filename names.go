@@ -0,0 +1,126 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxNameLen is the max length in bytes of a path component (NAME_MAX)
+const maxNameLen = 255
+
+// sanitizeName makes name a valid path component
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/':
+			return '-'
+		case r < ' ' || r == utf8.RuneError:
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	switch name {
+	case "", ".", "..":
+		name = "_" + name
+	}
+	return truncateName(name, "")
+}
+
+// truncateName appends suffix to name before its extension
+// cutting name so the result fits in maxNameLen.
+func truncateName(name, suffix string) string {
+	ext := path.Ext(name)
+	if len(ext) > maxNameLen/4 {
+		// that is not an extension
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	max := maxNameLen - len(suffix) - len(ext)
+	for len(stem) > max {
+		_, n := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-n]
+	}
+	return stem + suffix + ext
+}
+
+// assignedName is a name given to an item
+type assignedName struct {
+	// sanitized name before disambiguation
+	base string
+	name string
+}
+
+// namer gives unique names to the items of every folder.
+//
+// Items sharing a name get their material id as a suffix.
+// Given names are remembered by item key, so an item keeps
+// its name across refreshes while its title does not change.
+type namer struct {
+	sync.Mutex
+	names map[string]assignedName
+}
+
+func newNamer() *namer {
+	return &namer{
+		names: make(map[string]assignedName),
+	}
+}
+
+// assign names items which are children of folder dir
+// and updates their paths.
+func (nm *namer) assign(dir string, items []*uaitem) {
+	nm.Lock()
+	defer nm.Unlock()
+
+	bases := make([]string, len(items))
+	count := make(map[string]int, len(items))
+	for i, it := range items {
+		bases[i] = sanitizeName(formatName(it.title))
+		count[bases[i]]++
+	}
+
+	used := make(map[string]bool, len(items))
+	pending := make([]int, 0, len(items))
+	// items keep their previous name if possible
+	for i, it := range items {
+		prev, ok := nm.names[it.key()]
+		if ok && prev.base == bases[i] && !used[prev.name] {
+			it.name = prev.name
+			used[it.name] = true
+			continue
+		}
+		pending = append(pending, i)
+	}
+	// deterministic order for new names
+	sort.Slice(pending, func(i, j int) bool {
+		return items[pending[i]].cod < items[pending[j]].cod
+	})
+	for _, i := range pending {
+		it := items[i]
+		name := bases[i]
+		if count[name] > 1 || used[name] {
+			name = truncateName(bases[i], " ["+it.cod+"]")
+		}
+		for n := 2; used[name]; n++ {
+			name = truncateName(bases[i], " ["+it.cod+"-"+strconv.Itoa(n)+"]")
+		}
+		it.name = name
+		used[name] = true
+		nm.names[it.key()] = assignedName{
+			base: bases[i],
+			name: name,
+		}
+	}
+
+	for _, it := range items {
+		it.path = dir
+		if it.folder {
+			it.path = path.Join(dir, it.name)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"Tema 1.pdf":          "Tema 1.pdf",
+		"Entrega 1/2.pdf":     "Entrega 1-2.pdf",
+		"/a//b/":              "-a--b-",
+		"tab\there.txt":       "tabhere.txt",
+		"nul\x00.txt":         "nul.txt",
+		"line\nbreak\r.txt":   "linebreak.txt",
+		"bad\xffutf8.txt":     "badutf8.txt",
+		"  espacios.txt  ":    "espacios.txt",
+		"":                    "_",
+		"\x00":                "_",
+		".":                   "_.",
+		"..":                  "_..",
+		"...":                 "...",
+		"Prácticas":           "Prácticas",
+		"\x1b[31mrojo\x1b[0m": "[31mrojo[0m",
+	} {
+		if got := sanitizeName(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	// 2 bytes per rune so the limit falls inside one
+	long := strings.Repeat("ñ", maxNameLen)
+	for _, tt := range []struct {
+		name, suffix string
+		// kept extension
+		ext string
+	}{
+		{long, "", ""},
+		{long + ".pdf", "", ".pdf"},
+		{"a" + long + ".pdf", "", ".pdf"},
+		{long + ".pdf", " [1001]", " [1001].pdf"},
+		{"a" + long, " [1001-2]", " [1001-2]"},
+		// too long to be an extension
+		{"a." + long, "", ""},
+	} {
+		got := truncateName(tt.name, tt.suffix)
+		switch {
+		case len(got) > maxNameLen:
+			t.Errorf("%d bytes + %q: got %d bytes", len(tt.name), tt.suffix, len(got))
+		case len(got) < maxNameLen-1:
+			t.Errorf("%d bytes + %q: cut to %d bytes", len(tt.name), tt.suffix, len(got))
+		case !utf8.ValidString(got):
+			t.Errorf("%d bytes + %q: rune cut", len(tt.name), tt.suffix)
+		case !strings.HasSuffix(got, tt.ext):
+			t.Errorf("%d bytes + %q: got %q, want suffix %q", len(tt.name), tt.suffix, got[len(got)-20:], tt.ext)
+		}
+	}
+	if got := sanitizeName("a/" + long); len(got) > maxNameLen || !strings.HasPrefix(got, "a-") {
+		t.Errorf("sanitized: got %d bytes", len(got))
+	}
+}
+
+func TestNamerCollisions(t *testing.T) {
+	listing := func(cods ...string) []*uaitem {
+		items := make([]*uaitem, len(cods))
+		for i, cod := range cods {
+			title := "Tema.pdf"
+			if cod == "1009" {
+				title = "Otro.pdf"
+			}
+			items[i] = &uaitem{codasig: "34012", cod: cod, title: title}
+		}
+		return items
+	}
+	names := func(items []*uaitem) map[string]string {
+		m := make(map[string]string)
+		for _, it := range items {
+			m[it.cod] = it.name
+		}
+		return m
+	}
+
+	// refreshes of a folder
+	nm := newNamer()
+	for _, tt := range []struct {
+		cods []string
+		want map[string]string
+	}{
+		{[]string{"1002", "1001"}, map[string]string{
+			"1001": "Tema [1001].pdf",
+			"1002": "Tema [1002].pdf",
+		}},
+		{[]string{"1001", "1009", "1002"}, map[string]string{
+			"1001": "Tema [1001].pdf",
+			"1002": "Tema [1002].pdf",
+			"1009": "Otro.pdf",
+		}},
+		// items keep their names while others come and go
+		{[]string{"1003", "1002"}, map[string]string{
+			"1002": "Tema [1002].pdf",
+			"1003": "Tema [1003].pdf",
+		}},
+		{[]string{"1002"}, map[string]string{
+			"1002": "Tema [1002].pdf",
+		}},
+	} {
+		items := listing(tt.cods...)
+		nm.assign("/FC", items)
+		if got := names(items); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.cods, got, tt.want)
+		}
+	}
+
+	// new names do not depend on the order of the listing
+	a, b := listing("1001", "1002", "1003"), listing("1003", "1001", "1002")
+	newNamer().assign("/FC", a)
+	newNamer().assign("/FC", b)
+	if !reflect.DeepEqual(names(a), names(b)) {
+		t.Errorf("got %v and %v", names(a), names(b))
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// node is an element or a text of a parsed HTML document
+type node struct {
+	tag      string
+	attrs    map[string]string
+	children []*node
+	// contents of text nodes
+	text string
+	// a syntax error was found inside (see parseHTML)
+	broken bool
+}
+
+// attr returns attribute value of key or an empty string
+func (n *node) attr(key string) string {
+	return n.attrs[key]
+}
+
+// hasClass reports whether class attribute of n contains class
+func (n *node) hasClass(class string) bool {
+	for _, c := range strings.Fields(n.attrs["class"]) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns all descendants of n matching fn.
+// Descendants of matched nodes are not visited.
+func (n *node) find(fn func(*node) bool) []*node {
+	var nodes []*node
+	for _, c := range n.children {
+		if fn(c) {
+			nodes = append(nodes, c)
+			continue
+		}
+		nodes = append(nodes, c.find(fn)...)
+	}
+	return nodes
+}
+
+// first returns the first descendant of n matching fn or nil
+func (n *node) first(fn func(*node) bool) *node {
+	for _, c := range n.children {
+		if fn(c) {
+			return c
+		}
+		if nn := c.first(fn); nn != nil {
+			return nn
+		}
+	}
+	return nil
+}
+
+// blockElements separate the text around them
+var blockElements = map[string]bool{
+	"br": true, "p": true, "div": true, "li": true, "ul": true, "ol": true,
+	"tr": true, "td": true, "th": true, "table": true, "hr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// Text returns text contents of n and its descendants
+// with spaces collapsed. Line breaks and block elements
+// are replaced by a space.
+func (n *node) Text() string {
+	var b strings.Builder
+	n.writeText(&b)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func (n *node) writeText(b *strings.Builder) {
+	b.WriteString(n.text)
+	if blockElements[n.tag] {
+		b.WriteByte(' ')
+	}
+	for _, c := range n.children {
+		c.writeText(b)
+	}
+	if blockElements[n.tag] {
+		b.WriteByte(' ')
+	}
+}
+
+// byClass returns a matcher of elements with class
+func byClass(class string) func(*node) bool {
+	return func(n *node) bool {
+		return n.hasClass(class)
+	}
+}
+
+// withAttr returns a matcher of elements having attribute key
+func withAttr(key string) func(*node) bool {
+	return func(n *node) bool {
+		_, ok := n.attrs[key]
+		return ok
+	}
+}
+
+// textOf returns text of the first descendant of n matching fn
+func textOf(n *node, fn func(*node) bool) string {
+	if nn := n.first(fn); nn != nil {
+		return nn.Text()
+	}
+	return ""
+}
+
+// scripts and styles are not valid XML
+var rscript = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)\s*>`)
+
+// a < which does not start markup (ex: "a < b")
+var rbareLT = regexp.MustCompile(`<([^a-zA-Z/!?]|$)`)
+
+// start tags and their attributes. Quoted values are matched
+// so unquoted ones (ex: <img src=x.png>) can be told apart
+var (
+	rstartTag = regexp.MustCompile(`<[a-zA-Z][^<>]*>`)
+	rattrs    = regexp.MustCompile(`"[^"]*"|'[^']*'|=\s*[^\s"'<>]+`)
+)
+
+// quoteAttrs quotes unquoted attribute values of tag
+func quoteAttrs(tag []byte) []byte {
+	return rattrs.ReplaceAllFunc(tag, func(m []byte) []byte {
+		if m[0] != '=' {
+			return m
+		}
+		v := bytes.TrimLeft(m[1:], " \t\r\n")
+		return []byte(`="` + string(v) + `"`)
+	})
+}
+
+// voidElements are never closed
+var voidElements = make(map[string]bool)
+
+func init() {
+	for _, tag := range xml.HTMLAutoClose {
+		voidElements[tag] = true
+	}
+}
+
+// parseHTML parses an HTML document or fragment.
+//
+// Parsing is tolerant: unclosed elements are closed by their parents.
+// After a syntax error parsing goes on from the next tag and elements
+// open at the error are marked broken, so callers can skip them.
+// The first syntax error is returned with the whole document.
+func parseHTML(body []byte) (*node, error) {
+	body = rscript.ReplaceAll(body, nil)
+	body = rbareLT.ReplaceAll(body, []byte("&lt;$1"))
+	body = rstartTag.ReplaceAllFunc(body, quoteAttrs)
+
+	root := &node{}
+	stack := []*node{root}
+	var first error
+	for off := 0; off < len(body); {
+		d := xml.NewDecoder(bytes.NewReader(body[off:]))
+		d.Strict = false
+		d.Entity = xml.HTMLEntity
+		err := parseTokens(d, &stack)
+		if err == io.EOF {
+			break
+		}
+		if first == nil {
+			first = err
+		}
+		for _, n := range stack[1:] {
+			n.broken = true
+		}
+		// going on from the next tag
+		next := off + int(d.InputOffset())
+		i := bytes.IndexByte(body[next:], '<')
+		if i < 0 {
+			break
+		}
+		off = next + i
+		if off == next && d.InputOffset() == 0 {
+			// stuck at the same tag
+			off++
+		}
+	}
+	return root, first
+}
+
+// parseTokens adds tokens read from d to the tree
+// returning io.EOF or the first syntax error.
+// Start and end elements are matched by stack, not by d.
+func parseTokens(d *xml.Decoder, stack *[]*node) error {
+	for {
+		tok, err := d.RawToken()
+		if err != nil {
+			return err
+		}
+		top := (*stack)[len(*stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{
+				tag:   strings.ToLower(t.Name.Local),
+				attrs: make(map[string]string, len(t.Attr)),
+			}
+			for _, a := range t.Attr {
+				key := a.Name.Local
+				if a.Name.Space != "" {
+					key = a.Name.Space + ":" + key
+				}
+				n.attrs[strings.ToLower(key)] = a.Value
+			}
+			top.children = append(top.children, n)
+			if !voidElements[n.tag] {
+				*stack = append(*stack, n)
+			}
+		case xml.EndElement:
+			tag := strings.ToLower(t.Name.Local)
+			// closing unclosed children too
+			for i := len(*stack) - 1; i > 0; i-- {
+				if (*stack)[i].tag == tag {
+					*stack = (*stack)[:i]
+					break
+				}
+			}
+		case xml.CharData:
+			top.children = append(top.children, &node{text: string(t)})
+		}
+	}
+}
+
+// a character reference (ex: &oacute; or &#243;)
+var rentity = regexp.MustCompile(`&(#[0-9]+|#[xX][0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`)
+
+// unescapeTitle decodes references left in a decoded title.
+// UACloud escapes accented letters twice (ex: Introducci&amp;oacute;n)
+// but a title can really contain "&amp;", so references to ASCII
+// characters are kept.
+func unescapeTitle(s string) string {
+	return rentity.ReplaceAllStringFunc(s, func(ref string) string {
+		r := html.UnescapeString(ref)
+		for _, c := range r {
+			if c <= unicode.MaxASCII {
+				return ref
+			}
+		}
+		return r
+	})
+}
+
+// skippedRows is a syntax error of a listing
+// and the rows skipped because of it
+type skippedRows struct {
+	err error
+	// keys of the items of skipped rows (see uaitem.key)
+	keys []string
+}
+
+func (e *skippedRows) Error() string {
+	return fmt.Sprintf("%s (%d rows skipped)", e.err, len(e.keys))
+}
+
+func (e *skippedRows) Unwrap() error {
+	return e.err
+}
+
+// has reports whether the row of the item with key was skipped
+func (e *skippedRows) has(key string) bool {
+	for _, k := range e.keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// malformed returns the error of a document with syntax errors
+// where the rows of keys had to be skipped
+func malformed(err error, keys []string) error {
+	return &uaError{
+		kind: kindDecode,
+		err:  &skippedRows{err: err, keys: keys},
+	}
+}
+
+// parseFolders parses CursoMaterialesTodos response returning
+// a folder per subject. Paths are set by namer.assign.
+//
+// Every subject row has a data-codasi attribute and the subject name
+// inside a span with class asi. Malformed rows are skipped returning
+// the other subjects and an error.
+func parseFolders(body []byte) ([]*uaitem, error) {
+	doc, err := parseHTML(body)
+	rows := doc.find(func(n *node) bool {
+		return n.attr("data-codasi") != "" && n.first(byClass("asi")) != nil
+	})
+	items := make([]*uaitem, 0, len(rows))
+	var skipped []string
+	for _, row := range rows {
+		if row.broken {
+			skipped = append(skipped, path.Join(row.attr("data-codasi"), "-1"))
+			continue
+		}
+		title := unescapeTitle(textOf(row, byClass("asi")))
+		if title == "" {
+			continue
+		}
+		items = append(items, &uaitem{
+			folder:  true,
+			cod:     "-1",
+			codasig: row.attr("data-codasi"),
+			name:    formatName(title),
+			title:   title,
+			subject: title,
+		})
+	}
+	if err != nil {
+		return items, malformed(err, skipped)
+	}
+	return items, nil
+}
+
+// parseItems parses VistaMateriales response of folder parent.
+// Paths are set by namer.assign.
+//
+// Every material row has a data-id attribute and a class telling
+// if it is a folder (carpeta) or a file (archivo). Other rows
+// (like links) and rows without id or name are ignored.
+// Malformed rows are skipped returning the other items and an error.
+func parseItems(parent *uaitem, body []byte) ([]*uaitem, error) {
+	doc, err := parseHTML(body)
+	rows := doc.find(withAttr("data-id"))
+	items := make([]*uaitem, 0, len(rows))
+	var skipped []string
+	for _, row := range rows {
+		if row.broken {
+			// the text of cells can be cut
+			id := strings.TrimSpace(row.attr("data-id"))
+			skipped = append(skipped, path.Join(parent.codasig, id))
+			continue
+		}
+		folder := row.hasClass("carpeta")
+		if !folder && !row.hasClass("archivo") {
+			continue
+		}
+		cod := textOf(row, byClass("columna1"))
+		if cod == "" {
+			cod = strings.TrimSpace(row.attr("data-id"))
+		}
+		title := unescapeTitle(textOf(row, byClass("nombre")))
+		if cod == "" || title == "" {
+			continue
+		}
+		it := &uaitem{
+			cod:     cod,
+			codasig: parent.codasig,
+			name:    formatName(title),
+			folder:  folder,
+			title:   title,
+			subject: parent.subject,
+			author:  textOf(row, byClass("autor")),
+			desc:    textOf(row, byClass("descripcion")),
+			date:    parseDate(textOf(row, byClass("columna3"))),
+		}
+		if !folder {
+			it.size = parseSize(textOf(row, byClass("columna4")))
+		}
+		items = append(items, it)
+	}
+	if err != nil {
+		return items, malformed(err, skipped)
+	}
+	return items, nil
+}
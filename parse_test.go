@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files of testdata")
+
+// dump writes items one per line in a stable format
+func dump(items []*uaitem, err error) []byte {
+	var b bytes.Buffer
+	for _, it := range items {
+		kind := "file"
+		if it.folder {
+			kind = "folder"
+		}
+		date := "-"
+		if !it.date.IsZero() {
+			date = it.date.Format("2006-01-02T15:04:05")
+		}
+		fmt.Fprintf(&b, "%s %s %s %q size=%d date=%s author=%q desc=%q subject=%q\n",
+			kind, it.key(), it.fullpath(), it.title, it.size, date, it.author, it.desc, it.subject)
+	}
+	if err != nil {
+		fmt.Fprintf(&b, "error: %s\n", err)
+	}
+	return b.Bytes()
+}
+
+// golden compares got with testdata/name.golden
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	file := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(file, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs:\n--- got\n%s--- want\n%s", file, got, want)
+	}
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name+".html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestParseFolders(t *testing.T) {
+	items, err := parseFolders(readFixture(t, "folders"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newNamer().assign("/", items)
+	golden(t, "folders", dump(items, err))
+}
+
+func TestParseItems(t *testing.T) {
+	subject := &uaitem{
+		folder:  true,
+		cod:     "-1",
+		codasig: "34012",
+		path:    "/FUNDAMENTOS DE LOS COMPUTADORES",
+		subject: "FUNDAMENTOS DE LOS COMPUTADORES",
+	}
+	for _, name := range []string{"files", "links", "empty", "malformed"} {
+		t.Run(name, func(t *testing.T) {
+			items, err := parseItems(subject, readFixture(t, name))
+			if name == "malformed" {
+				if err == nil {
+					t.Fatal("no error parsing malformed rows")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			newNamer().assign(subject.path, items)
+			golden(t, name, dump(items, err))
+		})
+	}
+}
+
+func TestQuoteAttrs(t *testing.T) {
+	for tag, want := range map[string]string{
+		`<img src=x.png>`:               `<img src="x.png">`,
+		`<a href = /x?a=1 class="b">`:   `<a href ="/x?a=1" class="b">`,
+		`<td title="a b=c" id=d>`:       `<td title="a b=c" id="d">`,
+		`<td title='x=y'>`:              `<td title='x=y'>`,
+		`<input checked type=checkbox>`: `<input checked type="checkbox">`,
+	} {
+		if got := string(quoteAttrs([]byte(tag))); got != want {
+			t.Errorf("%s: got %s, want %s", tag, got, want)
+		}
+	}
+}
+
+func TestParseHTMLRecovers(t *testing.T) {
+	doc, err := parseHTML([]byte(`<p class="a">1 < 2</p><p class=b x="y>z</p><p class="c">ok</p>`))
+	if err == nil {
+		t.Error("no syntax error")
+	}
+	if got := textOf(doc, byClass("a")); got != "1 < 2" {
+		t.Errorf("bare <: got %q", got)
+	}
+	if got := textOf(doc, byClass("c")); got != "ok" {
+		t.Errorf("after error: got %q", got)
+	}
+	for _, p := range doc.find(byClass("a")) {
+		if p.broken {
+			t.Error("row before the error is broken")
+		}
+	}
+}
+
+func TestParseHTMLEmpty(t *testing.T) {
+	for body, text := range map[string]string{
+		"":       "",
+		"   ":    "",
+		"<":      "<",
+		"<html>": "",
+		"a=b":    "a=b",
+		// line breaks and blocks separate words
+		"a<br>b":               "a b",
+		"<p>a</p><p>b</p>":     "a b",
+		"<b>a</b>b":            "ab",
+		"<td>a\n  b</td><td>c": "a b c",
+	} {
+		doc, _ := parseHTML([]byte(body))
+		if got := strings.TrimSpace(doc.Text()); got != text {
+			t.Errorf("%q: got text %q, want %q", body, got, text)
+		}
+	}
+}
+
+func TestUsable(t *testing.T) {
+	parent := &uaitem{codasig: "34012"}
+	items, err := parseItems(parent, readFixture(t, "malformed"))
+	if !usable(items, err) {
+		t.Error("malformed listing is not used")
+	}
+	if usable(nil, errServer) {
+		t.Error("failed listing is used")
+	}
+
+	// the item of the skipped row is kept, removed ones are not
+	current := []*uaitem{
+		{codasig: "34012", cod: "3001", name: "a < b.txt"},
+		{codasig: "34012", cod: "3003", name: "roto.txt"},
+		{codasig: "34012", cod: "3006", name: "borrado.txt"},
+	}
+	var got []string
+	for _, it := range keepSkipped(items, current, err) {
+		got = append(got, it.cod)
+	}
+	if want := "3001 3002 3004 3005 3003"; strings.Join(got, " ") != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := keepSkipped(items, current, nil); len(got) != len(items) {
+		t.Errorf("items kept from a listing without errors")
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// crawl fetches a new tree of UACloud items without touching
+// the current one returning the subjects that could not be fetched.
+// Subjects of malformed rows of the list of subjects are returned
+// as failed too, so they are not taken as removed.
+// Returns nil items if folders cannot be fetched.
+func (root *FS) crawl(ctx context.Context) (items, failed []*uaitem, err error) {
+	items, err = root.getFolders(ctx)
+	if !usable(items, err) {
+		return nil, nil, err
+	}
+	var sr *skippedRows
+	if errors.As(err, &sr) {
+		for _, key := range sr.keys {
+			// only the code of the subject is known
+			codasig := path.Dir(key)
+			failed = append(failed, &uaitem{
+				folder:  true,
+				cod:     "-1",
+				codasig: codasig,
+				name:    codasig,
+			})
+		}
+	}
+	for i, serr := range root.getSubjects(ctx, items) {
+		if serr == nil {
+			continue
+		}
+		log.Printf("fetching %s: %s", items[i].name, serr)
+		if err == nil {
+			err = serr
+		}
+		failed = append(failed, items[i])
+	}
+	return items, failed, err
+}
+
+// subjectsError reports subjects that could not be fetched.
+// Other subjects are in the tree.
+type subjectsError struct {
+	subjects []*uaitem
+	// first error
+	err error
+}
+
+func (e *subjectsError) Error() string {
+	names := make([]string, len(e.subjects))
+	for i, it := range e.subjects {
+		names[i] = it.name
+	}
+	return fmt.Sprintf("cannot fetch %s: %s", strings.Join(names, ", "), e.err)
+}
+
+func (e *subjectsError) Unwrap() error {
+	return e.err
+}
+
+// has reports whether the material with key (see uaitem.key)
+// belongs to a subject that could not be fetched
+func (e *subjectsError) has(key string) bool {
+	if e == nil {
+		return false
+	}
+	for _, subject := range e.subjects {
+		if strings.HasPrefix(key, subject.codasig+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// inherit gives it the items of the current folder at its path
+// if it was loaded. Otherwise it keeps its items.
+// Items are shared as they are never modified once in the tree.
+func inherit(current []*uaitem, it *uaitem) {
+	for _, old := range current {
+		if old.folder && old.key() == it.key() && old.path == it.path && !old.loaded.IsZero() {
+			it.items, it.loaded = old.items, old.loaded
+		}
+	}
+}
+
+// treeDiff counts the changes of a refresh
+type treeDiff struct {
+	added, removed, renamed, changed int
+}
+
+func (d treeDiff) any() bool {
+	return d != treeDiff{}
+}
+
+func (d treeDiff) String() string {
+	return fmt.Sprintf("%d added, %d removed, %d renamed, %d changed",
+		d.added, d.removed, d.renamed, d.changed)
+}
+
+// index returns items and their children by key and by path
+func index(items []*uaitem, keys, paths map[string]*uaitem) {
+	for _, it := range items {
+		keys[it.key()] = it
+		paths[it.fullpath()] = it
+		index(it.items, keys, paths)
+	}
+}
+
+// same reports whether the listing of a material did not change
+// so it can be kept in the new tree.
+func (it *uaitem) same(newer *uaitem) bool {
+	return !it.folder && !newer.folder &&
+		it.fullpath() == newer.fullpath() &&
+		it.date.Equal(newer.date) &&
+		it.size == newer.size &&
+		it.title == newer.title &&
+		it.desc == newer.desc &&
+		it.author == newer.author &&
+		it.subject == newer.subject
+}
+
+// reuse replaces items of the new tree by the current ones
+// when they did not change, so nodes already given to the kernel
+// keep their item.
+func reuse(items []*uaitem, keys map[string]*uaitem) {
+	for i, it := range items {
+		// items of unchanged folders are shared with the current tree
+		if old := keys[it.key()]; old != nil && old != it && old.same(it) {
+			items[i] = old
+		}
+		reuse(it.items, keys)
+	}
+}
+
+// merge replaces the current tree by the one returned by build
+// applying the differences to the in-memory filesystem.
+// build gets the current tree and must not modify it.
+//
+// Readers never see a partial tree because everything is done
+// holding the lock. Cached contents of removed materials and of
+// materials updated in UACloud are dropped.
+// Returns kernel caches to invalidate (see invalidate).
+func (root *FS) merge(build func(current []*uaitem) []*uaitem) (treeDiff, *invalidation) {
+	var d treeDiff
+	var stale, changed []string
+
+	root.Lock()
+	items := build(root.items)
+	oldKeys, oldPaths := make(map[string]*uaitem), make(map[string]*uaitem)
+	index(root.items, oldKeys, oldPaths)
+	reuse(items, oldKeys)
+	newKeys, newPaths := make(map[string]*uaitem), make(map[string]*uaitem)
+	index(items, newKeys, newPaths)
+
+	// changes by material id
+	for key, old := range oldKeys {
+		it, ok := newKeys[key]
+		if !ok {
+			d.removed++
+			if !old.folder {
+				stale = append(stale, key)
+			}
+			continue
+		}
+		if old.fullpath() != it.fullpath() {
+			d.renamed++
+		}
+		if !old.folder && (!old.date.Equal(it.date) || old.size != it.size) {
+			d.changed++
+			stale = append(stale, key)
+		}
+	}
+	for key := range newKeys {
+		if _, ok := oldKeys[key]; !ok {
+			d.added++
+		}
+	}
+
+	// changes by path
+	for p, old := range oldPaths {
+		it, ok := newPaths[p]
+		if !ok || it.folder != old.folder {
+			root.Fs.RemoveAll(p)
+		}
+		if !ok || (!old.folder && it != old) {
+			// removed or not reused (see reuse)
+			changed = append(changed, p)
+		}
+	}
+	var added []string
+	for p, it := range newPaths {
+		if old, ok := oldPaths[p]; !ok || it.folder != old.folder {
+			added = append(added, p)
+		}
+		if _, ok := oldPaths[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	// parents first
+	sort.Strings(added)
+	for _, p := range added {
+		if newPaths[p].folder {
+			root.Fs.MkdirAll(p, 0777)
+			continue
+		}
+		file, err := root.Fs.Create(p)
+		if err == nil {
+			file.Close()
+		}
+	}
+
+	root.items = items
+	for _, key := range stale {
+		delete(root.partials, key)
+	}
+	root.facts.forget(stale)
+	inv := root.stale(changed)
+	root.Unlock()
+
+	for _, key := range stale {
+		root.cache.remove(key)
+	}
+	return d, inv
+}
+
+// validity is how long the kernel can cache entries and attributes.
+// Refreshes invalidate what changed but not every kernel supports it,
+// so stale entries do not outlive the next refresh.
+func validity() time.Duration {
+	return time.Duration(*cacheUpdate) * time.Minute
+}
+
+// invalidation are kernel caches to invalidate
+type invalidation struct {
+	// contents of files and listings of folders
+	nodes []fs.Node
+	// names by parent folder
+	entries map[fs.Node][]string
+}
+
+// stale returns kernel caches of the entries at paths and the
+// listings of their folders. Their nodes are forgotten so next
+// lookups get new nodes. root must be locked
+func (root *FS) stale(paths []string) *invalidation {
+	inv := &invalidation{
+		entries: make(map[fs.Node][]string),
+	}
+	for _, p := range paths {
+		if n, ok := root.nodes[p]; ok {
+			delete(root.nodes, p)
+			inv.nodes = append(inv.nodes, n)
+		}
+		if parent, ok := root.nodes[path.Dir(p)]; ok {
+			inv.entries[parent] = append(inv.entries[parent], path.Base(p))
+		}
+	}
+	return inv
+}
+
+// invalidate makes the kernel forget inv.
+//
+// Must not be called holding the lock nor serving a request:
+// the kernel can wait for requests on those nodes.
+func (root *FS) invalidate(inv *invalidation) {
+	if root.server == nil {
+		return
+	}
+	for _, n := range inv.nodes {
+		root.notify(root.server.InvalidateNodeData(n))
+	}
+	for parent, names := range inv.entries {
+		for _, name := range names {
+			root.notify(root.server.InvalidateEntry(parent, name))
+		}
+		root.notify(root.server.InvalidateNodeData(parent))
+	}
+}
+
+// invalidateAttr makes the kernel ask again for attributes of name
+func (root *FS) invalidateAttr(name string) {
+	if root.server == nil {
+		return
+	}
+	root.RLock()
+	n, ok := root.nodes[name]
+	root.RUnlock()
+	if ok {
+		root.notify(root.server.InvalidateNodeAttr(n))
+	}
+}
+
+// notify logs errors of kernel invalidations.
+// Nodes not cached by the kernel are not errors.
+func (root *FS) notify(err error) {
+	if err != nil && err != fuse.ErrNotCached {
+		debugf("invalidating kernel cache: %s", err)
+	}
+}
+
+// lookupItem finds the item at name holding the lock
+func (root *FS) lookupItem(name string) *uaitem {
+	root.RLock()
+	defer root.RUnlock()
+	return lookup(root.items, name)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"bazil.org/fuse/fs"
+	"github.com/LibreLABUA/uafs/fakeua"
+	"golang.org/x/net/context"
+)
+
+// TestMergeChanged checks materials updated in UACloud
+// without changing their date are not served from the cache.
+func TestMergeChanged(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	tema := fetched(t, root, "/FUNDAMENTOS DE LOS COMPUTADORES/Tema 1.pdf")
+	downloaded(t, root, tema)
+	apuntes := fetched(t, root, "/Cálculo/apuntes.txt")
+	downloaded(t, root, apuntes)
+
+	// same dates, other contents. apuntes.txt keeps its size
+	srv.Update(func() {
+		srv.Subjects[0].Items[0].Content = []byte("contenido del tema 1 corregido")
+		srv.Subjects[1].Items[0].Content = []byte("integrals")
+	})
+	it := fetched(t, root, "/FUNDAMENTOS DE LOS COMPUTADORES/Tema 1.pdf")
+	if it == tema {
+		t.Error("material of another size reused")
+	}
+	if root.cache.get(tema.key()) != nil {
+		t.Error("material of another size still cached")
+	}
+
+	// the size of apuntes.txt is not listed
+	if root.cache.get(apuntes.key()) == nil {
+		t.Fatal("material without size dropped before probing it")
+	}
+	// probed by a new mount
+	root = testFS(t)
+	it = fetched(t, root, "/Cálculo/apuntes.txt")
+	if size := root.sizeOf(context.Background(), it); size != int64(len("integrals")) {
+		t.Errorf("probed size %d", size)
+	}
+	if root.cache.get(apuntes.key()) != nil {
+		t.Error("material of another ETag still cached")
+	}
+	if got := downloaded(t, root, it); string(got) != "integrals" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestMergeInvalidation(t *testing.T) {
+	srv := startFake(t, testSubjects()...)
+	root := testFS(t)
+	if err := root.fetch(); err != nil {
+		t.Fatal(err)
+	}
+	const (
+		subject = "/FUNDAMENTOS DE LOS COMPUTADORES"
+		tema    = subject + "/Tema 1.pdf"
+		folder  = subject + "/Prácticas"
+		apuntes = "/Cálculo/apuntes.txt"
+	)
+	// nodes given to the kernel
+	nodes := map[string]fs.Node{
+		"/":        root.node("/", true),
+		subject:    root.node(subject, true),
+		tema:       root.node(tema, false),
+		folder:     root.node(folder, true),
+		"/Cálculo": root.node("/Cálculo", true),
+		apuntes:    root.node(apuntes, false),
+	}
+
+	// a material updated, one removed and one added
+	srv.Update(func() {
+		items := srv.Subjects[0].Items
+		items[0].Date = items[0].Date.Add(time.Hour)
+		items[1].Items = []*fakeua.Item{
+			{ID: "1004", Name: "p2.txt", Content: []byte("práctica 2\n")},
+		}
+	})
+	items, _, err := root.crawl(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, inv := root.merge(func([]*uaitem) []*uaitem { return items })
+	if want := (treeDiff{added: 1, removed: 1, changed: 1}); d != want {
+		t.Errorf("got %s, want %s", d, want)
+	}
+
+	// contents of changed nodes
+	if len(inv.nodes) != 1 || inv.nodes[0] != nodes[tema] {
+		t.Errorf("got %d nodes, want %s", len(inv.nodes), tema)
+	}
+	// entries by folder
+	entries := make(map[string][]string)
+	for p, n := range nodes {
+		if names, ok := inv.entries[n]; ok {
+			sort.Strings(names)
+			entries[p] = names
+		}
+	}
+	want := map[string][]string{
+		subject: {"Tema 1.pdf"},
+		folder:  {"p1.txt", "p2.txt"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got entries %q, want %q", entries, want)
+	}
+
+	// next lookups get new nodes
+	if root.node(tema, false) == nodes[tema] {
+		t.Error("node of a changed material kept")
+	}
+	if root.node(apuntes, false) != nodes[apuntes] {
+		t.Error("node of an unchanged material replaced")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/howeyc/gopass"
+)
+
+// secret holds a password that can be wiped from memory.
+//
+// It is never converted to string so no copies are left around.
+type secret struct {
+	b []byte
+}
+
+// newSecret returns a secret holding b. b is wiped by Wipe.
+func newSecret(b []byte) *secret {
+	return &secret{b: b}
+}
+
+// Bytes returns secret contents. Do not keep them.
+func (s *secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.b
+}
+
+// Empty reports whether s holds no password
+func (s *secret) Empty() bool {
+	return s == nil || len(s.b) == 0
+}
+
+// Wipe overwrites secret contents
+func (s *secret) Wipe() {
+	if s == nil {
+		return
+	}
+	for i := range s.b {
+		s.b[i] = 0
+	}
+	s.b = s.b[:0]
+}
+
+// String avoids printing secrets by mistake
+func (s *secret) String() string {
+	return "<secret>"
+}
+
+// secretTool is the freedesktop Secret Service client (libsecret).
+// Changing it allows using a local mock.
+var secretTool = "secret-tool"
+
+// secretFromCommand runs command using the shell
+// returning the first line of its output (like pass or gopass do).
+func secretFromCommand(command string) (*secret, error) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("password command: %s", err)
+	}
+	if i := bytes.IndexByte(out, '\n'); i >= 0 {
+		// wiping the rest of the output
+		for j := i; j < len(out); j++ {
+			out[j] = 0
+		}
+		out = out[:i]
+	}
+	if len(out) == 0 {
+		return nil, errors.New("password command: empty password")
+	}
+	return newSecret(out), nil
+}
+
+// secretFromKeyring looks for the password of user in the
+// freedesktop Secret Service. It can be stored using:
+//
+//	secret-tool store --label uafs service uafs user <username>
+func secretFromKeyring(user string) (*secret, error) {
+	out, err := keyringLookup("service", "uafs", "user", user)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("secret service: no password stored for %s", user)
+	}
+	return newSecret(out), nil
+}
+
+// keyringLookup returns the secret stored with the given attributes
+// in the Secret Service or nothing if there is none.
+func keyringLookup(attrs ...string) ([]byte, error) {
+	cmd := exec.Command(secretTool, append([]string{"lookup"}, attrs...)...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && len(out) == 0 {
+		// secret-tool fails if nothing is found
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secret service: %s", err)
+	}
+	return bytes.TrimRight(out, "\n"), nil
+}
+
+// keyringStore stores b in the Secret Service with the given attributes
+func keyringStore(label string, b []byte, attrs ...string) error {
+	cmd := exec.Command(secretTool, append([]string{"store", "--label", label}, attrs...)...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("secret service: %s", err)
+	}
+	return nil
+}
+
+// secretFromPrompt asks for the password in the terminal
+func secretFromPrompt() (*secret, error) {
+	fmt.Printf("Password: ")
+	p, err := gopass.GetPasswd()
+	if err != nil {
+		return nil, err
+	}
+	return newSecret(p), nil
+}
+
+// secretFromFile reads the password from an inherited file
+// (see daemonize) closing it.
+func secretFromFile(file *os.File) (*secret, error) {
+	defer file.Close()
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return newSecret(b), nil
+}
+
+// storedSecret returns the password of user from a password
+// command or the Secret Service if one of them is selected.
+// Returns nil otherwise. Unlike getSecret it can be used
+// without a terminal (ex: to log in again, see uaclient.relogin).
+func storedSecret(user string) (*secret, error) {
+	switch {
+	case *passCmd != "":
+		return secretFromCommand(*passCmd)
+	case *keyring:
+		return secretFromKeyring(user)
+	}
+	return nil, nil
+}
+
+// getSecret returns the password of user using the selected source:
+// a password command, the Secret Service or the terminal.
+// It is never read from the environment, where other processes
+// of the user can read it (/proc/<pid>/environ).
+func getSecret(user string) (*secret, error) {
+	if pass, err := storedSecret(user); pass != nil || err != nil {
+		return pass, err
+	}
+	return secretFromPrompt()
+}
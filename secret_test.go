@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeKeyring makes secretFromKeyring use testdata/secret-tool
+// storing secrets in a temporary directory
+func fakeKeyring(t *testing.T) {
+	t.Helper()
+	tool, err := filepath.Abs("testdata/secret-tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := secretTool
+	t.Cleanup(func() { secretTool = old })
+	secretTool = tool
+	t.Setenv("SECRET_TOOL_DIR", t.TempDir())
+}
+
+// storeSecret stores pass like a user would do (see README.md)
+func storeSecret(t *testing.T, user, pass string) {
+	t.Helper()
+	cmd := exec.Command(secretTool, "store", "--label", "uafs", "service", "uafs", "user", user)
+	cmd.Stdin = strings.NewReader(pass)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+}
+
+func TestSecretFromKeyring(t *testing.T) {
+	fakeKeyring(t)
+	storeSecret(t, testUser, testPass+"\n")
+
+	pass, err := secretFromKeyring(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pass.Bytes()) != testPass {
+		t.Errorf("got %q, want %q", pass.Bytes(), testPass)
+	}
+	if _, err := secretFromKeyring("otro@alu.ua.es"); err == nil {
+		t.Error("no error without a stored password")
+	}
+}
+
+func TestSecretFromCommand(t *testing.T) {
+	for _, tt := range []struct {
+		command string
+		pass    string
+		fails   bool
+	}{
+		{command: "echo " + testPass, pass: testPass},
+		// like pass: the password is the first line
+		{command: "printf '" + testPass + "\\nurl: https://cvnet.cpd.ua.es\\n'", pass: testPass},
+		{command: "printf " + testPass, pass: testPass},
+		{command: "true", fails: true},
+		{command: "echo", fails: true},
+		{command: "exit 3", fails: true},
+	} {
+		pass, err := secretFromCommand(tt.command)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: no error", tt.command)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.command, err)
+			continue
+		}
+		if string(pass.Bytes()) != tt.pass {
+			t.Errorf("%s: got %q, want %q", tt.command, pass.Bytes(), tt.pass)
+		}
+	}
+}
+
+func TestStoredSecret(t *testing.T) {
+	fakeKeyring(t)
+	storeSecret(t, testUser, "del keyring")
+	oldCmd, oldKeyring := *passCmd, *keyring
+	defer func() { *passCmd, *keyring = oldCmd, oldKeyring }()
+
+	*passCmd, *keyring = "", false
+	if pass, err := storedSecret(testUser); pass != nil || err != nil {
+		t.Errorf("got %v, %v without a source", pass, err)
+	}
+	*keyring = true
+	if pass, err := storedSecret(testUser); err != nil || string(pass.Bytes()) != "del keyring" {
+		t.Errorf("keyring: got %q, %v", pass.Bytes(), err)
+	}
+	// -pass-cmd goes first
+	*passCmd = "echo del comando"
+	if pass, err := storedSecret(testUser); err != nil || string(pass.Bytes()) != "del comando" {
+		t.Errorf("pass-cmd: got %q, %v", pass.Bytes(), err)
+	}
+}
+
+// TestDaemonize checks the password reaches the daemon.
+// The daemon is this test binary (see TestMain).
+func TestDaemonize(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "uafs.log")
+	err := daemonize(logFile, newSecret([]byte(testPass)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the daemon is not our child anymore
+	want := []byte("password: " + testPass + "\n")
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		out, _ := ioutil.ReadFile(logFile)
+		if bytes.Equal(out, want) {
+			return
+		}
+		if bytes.Contains(out, []byte("\n")) {
+			t.Fatalf("daemon wrote %q, want %q", out, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("daemon did not answer")
+}
+
+// daemonMain is the daemon started by TestDaemonize.
+// It writes the inherited password to the log.
+func daemonMain() int {
+	pass, err := inheritedSecret()
+	if err != nil {
+		os.Stdout.WriteString("error: " + err.Error() + "\n")
+		return 1
+	}
+	os.Stdout.WriteString("password: " + string(pass.Bytes()) + "\n")
+	return 0
+}
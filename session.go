@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/erikdubbelboer/fasthttp"
+	"github.com/themester/fcookiejar"
+	"golang.org/x/net/context"
+)
+
+// sessionTTL is how long a session is reused
+// when its cookies do not tell when they expire.
+const sessionTTL = 8 * time.Hour
+
+var (
+	errNoSession      = errors.New("no saved session")
+	errSessionExpired = errors.New("saved session expired")
+	errSessionInvalid = errors.New("saved session rejected by UACloud")
+)
+
+// session is the saved state of a CAS login
+type session struct {
+	User string `json:"user"`
+	// CAS service the session belongs to (see backend)
+	Service string    `json:"service"`
+	Saved   time.Time `json:"saved"`
+	Expires time.Time `json:"expires"`
+	// cookies in Set-Cookie format
+	Cookies []string `json:"cookies"`
+}
+
+// configDir returns uafs configuration directory
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = path.Join(dir, "uafs")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// sessionKey returns the key used to encrypt sessions
+// creating it the first time.
+//
+// The key is kept in the Secret Service using -keyring. Otherwise
+// it is a file next to the sessions, so encryption only hides
+// them from casual reads (like backups or grep).
+func sessionKey(dir string) ([]byte, error) {
+	if *keyring {
+		return keyringSessionKey()
+	}
+	file := path.Join(dir, "key")
+	key, err := ioutil.ReadFile(file)
+	if err == nil && len(key) == 32 {
+		return key, nil
+	}
+	key = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(file, key, 0600)
+}
+
+// attributes of the session key in the Secret Service
+var sessionKeyAttrs = []string{"service", "uafs", "type", "session-key"}
+
+// keyringSessionKey returns the session key stored in the
+// Secret Service creating it the first time (see sessionKey)
+func keyringSessionKey() ([]byte, error) {
+	b, err := keyringLookup(sessionKeyAttrs...)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(string(b))
+	if err == nil && len(key) == 32 {
+		return key, nil
+	}
+	key = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	b = []byte(base64.StdEncoding.EncodeToString(key))
+	return key, keyringStore("uafs session key", b, sessionKeyAttrs...)
+}
+
+// sessionCipher returns the cipher used to encrypt sessions
+// and the session file of user.
+func sessionCipher(user string) (cipher.AEAD, string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := sessionKey(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+	return gcm, path.Join(dir, "session-"+user), nil
+}
+
+// saveSession saves cookies of user encrypted
+func saveSession(user string, cookies *cookiejar.CookieJar) error {
+	gcm, file, err := sessionCipher(user)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s := session{
+		User:    user,
+		Service: endpoints.Service,
+		Saved:   now,
+		Expires: now.Add(sessionTTL),
+	}
+	for _, c := range *cookies {
+		exp := c.Expire()
+		if exp != fasthttp.CookieExpireUnlimited && exp.Before(s.Expires) {
+			s.Expires = exp
+		}
+		s.Cookies = append(s.Cookies, c.String())
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	// user is authenticated data so sessions cannot be swapped
+	data = gcm.Seal(nonce, nonce, data, []byte(user))
+
+	err = ioutil.WriteFile(file+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// loadSession loads saved cookies of user
+// if the session has not expired.
+func loadSession(user string) (*cookiejar.CookieJar, error) {
+	gcm, file, err := sessionCipher(user)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = errNoSession
+		}
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errNoSession
+	}
+	data, err = gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(user))
+	if err != nil {
+		return nil, err
+	}
+	var s session
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, err
+	}
+	if s.User != user || time.Now().After(s.Expires) {
+		return nil, errSessionExpired
+	}
+	if s.Service != endpoints.Service {
+		// saved for other backend
+		return nil, errNoSession
+	}
+
+	cookies := cookiejar.AcquireCookieJar()
+	for _, raw := range s.Cookies {
+		c := fasthttp.AcquireCookie()
+		if c.Parse(raw) != nil {
+			fasthttp.ReleaseCookie(c)
+			continue
+		}
+		cookies.Put(c)
+	}
+	return cookies, nil
+}
+
+// removeSession deletes saved session of user
+func removeSession(user string) error {
+	_, file, err := sessionCipher(user)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(file)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// resume reuses the saved session of user
+// checking UACloud still accepts it.
+func resume(ctx context.Context, user string) (*fasthttp.Client, *cookiejar.CookieJar, error) {
+	cookies, err := loadSession(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := newClient()
+
+	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI(endpoints.Home)
+	err = doReqFollowRedirects(ctx, req, res, client, cookies)
+	if errors.Is(err, errExpired) || err == nil && regexep.Match(res.Body()) {
+		// redirected to CAS login form
+		err = errSessionInvalid
+		removeSession(user)
+	}
+	if err != nil {
+		cookiejar.ReleaseCookieJar(cookies)
+		return nil, nil, err
+	}
+	return client, cookies, nil
+}
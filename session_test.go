@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/themester/fcookiejar"
+)
+
+// testCookies returns a jar with a session cookie
+func testCookies() *cookiejar.CookieJar {
+	cookies := cookiejar.AcquireCookieJar()
+	cookies.Set("ASP.NET_SessionId", "abc123")
+	return cookies
+}
+
+// roundTrip saves and loads a session returning the session cookie
+func roundTrip(t *testing.T) string {
+	t.Helper()
+	if err := saveSession(testUser, testCookies()); err != nil {
+		t.Fatal(err)
+	}
+	cookies, err := loadSession(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cookies.Peek("ASP.NET_SessionId")
+	if c == nil {
+		t.Fatal("session cookie not loaded")
+	}
+	return string(c.Value())
+}
+
+func TestSessionFileKey(t *testing.T) {
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	if got := roundTrip(t); got != "abc123" {
+		t.Errorf("got cookie %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(config, "uafs", "key")); err != nil {
+		t.Error("key not saved:", err)
+	}
+}
+
+func TestSessionKeyringKey(t *testing.T) {
+	fakeKeyring(t)
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	old := *keyring
+	defer func() { *keyring = old }()
+	*keyring = true
+
+	if got := roundTrip(t); got != "abc123" {
+		t.Errorf("got cookie %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(config, "uafs", "key")); !os.IsNotExist(err) {
+		t.Error("key saved next to the session")
+	}
+	key, err := keyringLookup(sessionKeyAttrs...)
+	if err != nil || len(key) == 0 {
+		t.Fatalf("key not in the keyring: %q, %v", key, err)
+	}
+	// the same key is used again
+	if got := roundTrip(t); got != "abc123" {
+		t.Errorf("got cookie %q", got)
+	}
+	if again, _ := keyringLookup(sessionKeyAttrs...); string(again) != string(key) {
+		t.Error("key replaced")
+	}
+
+	// sessions cannot be read without the key
+	*keyring = false
+	if _, err := loadSession(testUser); err == nil {
+		t.Error("session loaded without the keyring")
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/erikdubbelboer/fasthttp"
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+// chunkSize is the size of each ranged request
+const chunkSize = 1 << 20
+
+// transfer downloads a material into the cache by chunks
+// using HTTP Range requests, so readers can start reading
+// before the whole file has been downloaded.
+//
+// Chunks are fetched sequentially but the ones readers
+// are waiting for are fetched first. When every reader is gone
+// the transfer stops and what has been downloaded is kept
+// to be resumed by the next one (see partial).
+type transfer struct {
+	sync.Mutex
+	cond *sync.Cond
+	// canceled when the last reader goes away
+	ctx    context.Context
+	cancel context.CancelFunc
+	fs     *FS
+	item   *uaitem
+	key    string
+	// cache temporary file (see diskCache.create)
+	file afero.File
+	// total size. -1 until the first response
+	size int64
+	etag string
+	// downloaded chunks
+	have []bool
+	// chunks readers are waiting for
+	wanted []int
+	// open readers
+	readers int
+	done    bool
+	err     error
+}
+
+// partial is an interrupted transfer
+type partial struct {
+	size int64
+	etag string
+	have []bool
+}
+
+// stream returns the transfer of item starting it if needed.
+// Returned transfer must be released using release.
+func (fs *FS) stream(item *uaitem) (*transfer, error) {
+	key := item.key()
+	fs.Lock()
+	defer fs.Unlock()
+	for {
+		t, ok := fs.transfers[key]
+		if !ok {
+			break
+		}
+		t.Lock()
+		if t.ctx.Err() == nil {
+			t.readers++
+			t.Unlock()
+			return t, nil
+		}
+		t.Unlock()
+		// stopping. waiting for it to save its progress
+		fs.Unlock()
+		t.wait(context.Background())
+		fs.Lock()
+	}
+
+	t := &transfer{
+		fs:      fs,
+		item:    item,
+		key:     key,
+		size:    -1,
+		readers: 1,
+	}
+	if p, ok := fs.partials[key]; ok {
+		delete(fs.partials, key)
+		file, err := fs.cache.reopen(key)
+		if err == nil {
+			t.file = file
+			t.size, t.etag, t.have = p.size, p.etag, p.have
+		}
+	}
+	if t.file == nil {
+		file, err := fs.cache.create(key)
+		if err != nil {
+			return nil, err
+		}
+		t.file = file
+	}
+	// the chunk being fetched is aborted too
+	t.ctx, t.cancel = context.WithCancel(abortable(context.Background()))
+	t.cond = sync.NewCond(&t.Mutex)
+	fs.transfers[key] = t
+	go t.run()
+	return t, nil
+}
+
+// release releases a transfer acquired with stream
+// stopping it if nobody else is waiting for it.
+func (t *transfer) release() {
+	t.Lock()
+	t.readers--
+	if !t.done && t.readers == 0 {
+		t.cancel()
+	}
+	if t.done {
+		if t.err == nil {
+			t.fs.cache.unpin(t.key)
+		}
+		if t.readers == 0 {
+			t.file.Close()
+		}
+	}
+	t.Unlock()
+}
+
+// interrupt wakes up goroutines waiting on t when ctx is done.
+// Returned func must be called after waiting.
+func (t *transfer) interrupt(ctx context.Context) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.Lock()
+			t.cond.Broadcast()
+			t.Unlock()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// wait waits until the transfer finishes or ctx is done
+func (t *transfer) wait(ctx context.Context) error {
+	defer t.interrupt(ctx)()
+	t.Lock()
+	defer t.Unlock()
+	for !t.done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t.cond.Wait()
+	}
+	return t.err
+}
+
+// read reads len(p) bytes from off waiting for
+// the needed chunks to be downloaded or ctx to be done.
+func (t *transfer) read(ctx context.Context, p []byte, off int64) (int, error) {
+	defer t.interrupt(ctx)()
+	t.Lock()
+	for {
+		if t.err != nil {
+			t.Unlock()
+			return 0, t.err
+		}
+		if err := ctx.Err(); err != nil {
+			t.Unlock()
+			return 0, err
+		}
+		if t.size >= 0 {
+			if off >= t.size {
+				t.Unlock()
+				return 0, io.EOF
+			}
+			if end := off + int64(len(p)); end > t.size {
+				p = p[:t.size-off]
+			}
+			if t.want(off, off+int64(len(p))) {
+				break
+			}
+		}
+		t.cond.Wait()
+	}
+	t.Unlock()
+	return t.file.ReadAt(p, off)
+}
+
+// want reports whether bytes from off to end have been downloaded
+// asking for the missing chunks otherwise. t must be locked
+func (t *transfer) want(off, end int64) bool {
+	ok := true
+	for n := int(off / chunkSize); int64(n)*chunkSize < end; n++ {
+		if !t.have[n] {
+			ok = false
+			t.wanted = append(t.wanted, n)
+		}
+	}
+	return ok
+}
+
+// next returns the next chunk to download or -1. t must be locked
+func (t *transfer) next() int {
+	for len(t.wanted) > 0 {
+		n := t.wanted[0]
+		t.wanted = t.wanted[1:]
+		// chunks past the end if it changed
+		if n < len(t.have) && !t.have[n] {
+			return n
+		}
+	}
+	for n := range t.have {
+		if !t.have[n] {
+			return n
+		}
+	}
+	return -1
+}
+
+// run downloads all chunks and stores the file in the cache
+func (t *transfer) run() {
+	var err error
+	t.Lock()
+	n := 0
+	if t.have != nil {
+		// resumed
+		n = t.next()
+	}
+	t.Unlock()
+	for n >= 0 {
+		err = t.fetch(n)
+		if err == nil {
+			// aborted between chunks
+			err = t.ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+		t.Lock()
+		n = t.next()
+		t.Unlock()
+	}
+	if err == nil {
+		err = t.file.Sync()
+	}
+
+	// finished transfers cannot be found by stream
+	t.fs.Lock()
+	defer t.fs.Unlock()
+	delete(t.fs.transfers, t.key)
+
+	t.Lock()
+	if err == nil {
+		err = t.fs.cache.store(t.key, t.etag)
+	}
+	if err == nil {
+		// current readers keep the file pinned
+		for i := 0; i < t.readers; i++ {
+			t.fs.cache.pin(t.key)
+		}
+	} else if errors.Is(err, context.Canceled) && t.have != nil {
+		// kept for the next transfer
+		t.fs.partials[t.key] = &partial{
+			size: t.size,
+			etag: t.etag,
+			have: t.have,
+		}
+	} else {
+		t.fs.cache.disk.Remove(t.key + ".part")
+	}
+	t.cancel()
+	t.err = err
+	t.done = true
+	t.wanted = nil
+	if t.readers == 0 {
+		t.file.Close()
+	}
+	t.cond.Broadcast()
+	t.Unlock()
+	if err == nil {
+		// the size shown before downloading can be wrong.
+		// fs is locked until run returns
+		go t.fs.invalidateAttr(t.item.fullpath())
+	}
+}
+
+// fetch downloads chunk n
+func (t *transfer) fetch(n int) error {
+	args := fasthttp.AcquireArgs()
+	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseArgs(args)
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	args.Set("identificadores", t.item.cod)
+	args.Set("codasis", t.item.codasig)
+	args.WriteTo(req.BodyWriter())
+
+	req.SetRequestURI(endpoints.Download)
+	req.Header.SetContentType("application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8")
+	// ranges of compressed bodies are useless
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.SetMethod("POST")
+	start := n * chunkSize
+	req.Header.SetByteRange(start, start+chunkSize-1)
+
+	err := t.fs.ua.Do(t.ctx, req, res)
+	var ue *uaError
+	unsatisfiable := errors.As(err, &ue) && ue.status == fasthttp.StatusRequestedRangeNotSatisfiable
+	if err != nil && !unsatisfiable {
+		return err
+	}
+	body := res.Body()
+
+	t.Lock()
+	defer func() {
+		t.cond.Broadcast()
+		t.Unlock()
+	}()
+	etag := string(res.Header.Peek("ETag"))
+	var size int64
+	switch {
+	case unsatisfiable:
+		// nothing from start on. Content-Range: bytes */<size>
+		body, size = nil, int64(start)
+		cr := res.Header.Peek("Content-Range")
+		if i := bytes.LastIndexByte(cr, '/'); i >= 0 {
+			size, err = strconv.ParseInt(string(cr[i+1:]), 10, 64)
+			if err != nil {
+				return err
+			}
+		}
+	case res.Header.StatusCode() == fasthttp.StatusPartialContent:
+		// Content-Range: bytes <start>-<end>/<size>
+		cr := res.Header.Peek("Content-Range")
+		i := bytes.LastIndexByte(cr, '/')
+		if i < 0 {
+			return &uaError{
+				kind: kindDecode,
+				err:  fmt.Errorf("invalid Content-Range: %s", cr),
+			}
+		}
+		size, err = strconv.ParseInt(string(cr[i+1:]), 10, 64)
+		if err != nil {
+			return err
+		}
+	default:
+		// range not supported. body is the whole file
+		start, size = 0, int64(len(body))
+	}
+	if len(body) == 0 && int64(start) < size {
+		return io.ErrUnexpectedEOF
+	}
+	if t.size >= 0 && (size != t.size || etag != t.etag) {
+		// changed since the transfer started. Chunks downloaded
+		// are useless and the file can be shorter now
+		t.size = -1
+		err = t.file.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+	if t.size < 0 {
+		t.size = size
+		t.etag = etag
+		t.fs.facts.learn(t.key, size, string(res.Header.ContentType()))
+		t.have = make([]bool, (size+chunkSize-1)/chunkSize)
+	}
+
+	if len(body) > 0 {
+		_, err = t.file.WriteAt(body, int64(start))
+		if err != nil {
+			return err
+		}
+	}
+	end := int64(start + len(body))
+	if end == t.size {
+		// last chunk can be smaller
+		end += chunkSize - 1
+	}
+	for i := start / chunkSize; int64(i+1)*chunkSize <= end && i < len(t.have); i++ {
+		t.have[i] = true
+	}
+	return nil
+}
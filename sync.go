@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// syncDelete makes sync remove local files removed from UACloud
+var syncDelete = flag.Bool("delete", false, "sync: delete files removed from UACloud")
+
+// syncStateName is the state file of a synced directory
+const syncStateName = ".uafs-sync.json"
+
+// syncedFile is a material written by sync
+type syncedFile struct {
+	// path relative to the synced directory
+	Path string    `json:"path"`
+	Size int64     `json:"size"`
+	Date time.Time `json:"date"`
+	// size shown by UACloud. 0 if unknown
+	Listed int64 `json:"listed,omitempty"`
+	// when it was downloaded
+	Synced time.Time `json:"synced"`
+}
+
+// syncState is what the last sync wrote, so next runs
+// only download new or changed materials.
+type syncState struct {
+	User string `json:"user"`
+	// by item key
+	Files map[string]*syncedFile `json:"files"`
+}
+
+// syncStats counts what a sync did
+type syncStats struct {
+	downloaded, moved, unchanged, deleted, failed int
+}
+
+func (s syncStats) String() string {
+	return fmt.Sprintf("%d downloaded, %d moved, %d unchanged, %d deleted, %d failed",
+		s.downloaded, s.moved, s.unchanged, s.deleted, s.failed)
+}
+
+// loadSyncState reads the state of dir. Missing state is empty.
+func loadSyncState(dir, user string) (*syncState, error) {
+	st := &syncState{
+		User:  user,
+		Files: make(map[string]*syncedFile),
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, syncStateName))
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, st)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", syncStateName, err)
+	}
+	if st.User != user {
+		return nil, fmt.Errorf("%s is synced by %s", dir, st.User)
+	}
+	if st.Files == nil {
+		st.Files = make(map[string]*syncedFile)
+	}
+	return st, nil
+}
+
+// save writes the state of dir atomically
+func (st *syncState) save(dir string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, syncStateName), func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+// writeFileAtomic writes file using fn on a temporary file of the same
+// directory which is renamed to file only if everything went fine.
+func writeFileAtomic(file string, fn func(*os.File) error) error {
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = fn(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// unchanged reports whether it is the material synced as f
+func (f *syncedFile) unchanged(it *uaitem) bool {
+	// listed sizes are rounded (ex: 1,5 MB)
+	if it.size > 0 && f.Listed > 0 && it.size != f.Listed {
+		return false
+	}
+	return it.date.Equal(f.Date)
+}
+
+// syncer mirrors UACloud materials in a local directory
+type syncer struct {
+	root  *FS
+	dir   string
+	state *syncState
+	stats syncStats
+	// keys of the materials found in UACloud
+	seen map[string]bool
+	// folders found in UACloud
+	dirs map[string]bool
+	// subjects that could not be fetched. nil if none
+	failed *subjectsError
+}
+
+func runSync(args []string) error {
+	user, dir := username(args[0]), args[1]
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	state, err := loadSyncState(dir, user)
+	if err != nil {
+		return err
+	}
+	// subjects that cannot be fetched are not synced
+	root, ferr := openFS(user)
+	if root == nil {
+		return ferr
+	}
+	defer root.ua.wipe()
+	var failed *subjectsError
+	errors.As(ferr, &failed)
+
+	ctx, cancel := interruptible()
+	defer cancel()
+	s := &syncer{
+		root:   root,
+		dir:    dir,
+		state:  state,
+		seen:   make(map[string]bool),
+		dirs:   make(map[string]bool),
+		failed: failed,
+	}
+	err = s.sync(ctx, root.items)
+	if err == nil && *syncDelete {
+		s.prune()
+	}
+	// saving even if interrupted so the next run goes on
+	if serr := state.save(dir); err == nil {
+		err = serr
+	}
+	fmt.Println(s.stats)
+	if err == nil {
+		err = ferr
+	}
+	if err == nil && s.stats.failed > 0 {
+		err = errors.New("some materials could not be synced")
+	}
+	return err
+}
+
+// sync mirrors items and their children
+func (s *syncer) sync(ctx context.Context, items []*uaitem) error {
+	for _, it := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(it.fullpath(), "/")
+		if it.folder {
+			s.dirs[filepath.Join(s.dir, rel)] = true
+			err := os.MkdirAll(filepath.Join(s.dir, rel), 0755)
+			if err != nil {
+				return err
+			}
+			err = s.sync(ctx, it.items)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		s.seen[it.key()] = true
+		err := s.syncFile(ctx, it, rel)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("%s: %s", rel, err)
+			s.stats.failed++
+		}
+	}
+	return nil
+}
+
+// syncFile mirrors the material it at rel
+func (s *syncer) syncFile(ctx context.Context, it *uaitem, rel string) error {
+	file := filepath.Join(s.dir, rel)
+	prev := s.state.Files[it.key()]
+	if prev != nil && prev.unchanged(it) {
+		old := filepath.Join(s.dir, prev.Path)
+		if st, err := os.Stat(old); err == nil && st.Size() == prev.Size {
+			if prev.Path == rel {
+				s.stats.unchanged++
+				return nil
+			}
+			// renamed in UACloud
+			err := os.Rename(old, file)
+			if err == nil {
+				fmt.Printf("> %s -> %s\n", prev.Path, rel)
+				prev.Path = rel
+				s.stats.moved++
+				return nil
+			}
+		}
+	}
+
+	err := s.root.download(ctx, it)
+	if err != nil {
+		return err
+	}
+	src, err := s.root.cache.Fs.Open(it.key())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var size int64
+	err = writeFileAtomic(file, func(f *os.File) error {
+		n, err := io.Copy(f, src)
+		size = n
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !it.date.IsZero() {
+		os.Chtimes(file, time.Now(), it.date)
+	}
+	if prev != nil && prev.Path != rel {
+		// old copy of a renamed and changed material
+		os.Remove(filepath.Join(s.dir, prev.Path))
+	}
+	s.state.Files[it.key()] = &syncedFile{
+		Path:   rel,
+		Size:   size,
+		Date:   it.date,
+		Listed: it.size,
+		Synced: time.Now(),
+	}
+	fmt.Println("+", rel)
+	s.stats.downloaded++
+	return nil
+}
+
+// prune deletes synced files which are not in UACloud anymore
+// and the directories left empty.
+func (s *syncer) prune() {
+	for key, f := range s.state.Files {
+		if s.seen[key] || s.failed.has(key) {
+			// unknown if they are still in UACloud
+			continue
+		}
+		file := filepath.Join(s.dir, f.Path)
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("%s: %s", f.Path, err)
+			continue
+		}
+		delete(s.state.Files, key)
+		fmt.Println("-", f.Path)
+		s.stats.deleted++
+		// removing parents while they are empty
+		for dir := filepath.Dir(file); dir != filepath.Clean(s.dir) && !s.dirs[dir]; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSyncFailedSubject checks materials of subjects that cannot
+// be fetched are not deleted while the rest are synced.
+func TestSyncFailedSubject(t *testing.T) {
+	subjects := testSubjects()
+	srv := startFake(t, subjects...)
+	withPassword(t, "echo "+testPass)
+	old := *syncDelete
+	defer func() { *syncDelete = old }()
+	*syncDelete = true
+
+	dir := t.TempDir()
+	files := []string{
+		"FUNDAMENTOS DE LOS COMPUTADORES/Tema 1.pdf",
+		"FUNDAMENTOS DE LOS COMPUTADORES/Prácticas/p1.txt",
+		"Cálculo/apuntes.txt",
+	}
+	if err := runSync([]string{testUser, dir}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first subject cannot be listed and
+	// a material of the second one is removed
+	srv.Subjects[0].FailWith = 404
+	srv.Subjects[1].Items = nil
+	err := runSync([]string{testUser, dir})
+	if err == nil || !strings.Contains(err.Error(), "FUNDAMENTOS DE LOS COMPUTADORES") {
+		t.Errorf("got error %v, want the failed subject", err)
+	}
+	for _, f := range files[:2] {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("material of a failed subject pruned: %s", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, files[2])); !os.IsNotExist(err) {
+		t.Errorf("removed material not pruned: %v", err)
+	}
+}
+
+// TestSyncMalformedSubject checks materials of subjects whose row
+// in the list of subjects is malformed are not deleted.
+func TestSyncMalformedSubject(t *testing.T) {
+	subjects := testSubjects()
+	srv := startFake(t, subjects...)
+	withPassword(t, "echo "+testPass)
+	old := *syncDelete
+	defer func() { *syncDelete = old }()
+	*syncDelete = true
+
+	dir := t.TempDir()
+	if err := runSync([]string{testUser, dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the row of the second subject is skipped and
+	// a material of the first one is removed
+	srv.Subjects[1].Malformed = true
+	srv.Subjects[0].Items = srv.Subjects[0].Items[1:]
+	err := runSync([]string{testUser, dir})
+	if !errors.Is(err, errDecode) {
+		t.Errorf("got error %v, want %v", err, errDecode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Cálculo/apuntes.txt")); err != nil {
+		t.Errorf("material of a skipped subject pruned: %s", err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "FUNDAMENTOS DE LOS COMPUTADORES/Tema 1.pdf"))
+	if !os.IsNotExist(err) {
+		t.Errorf("removed material not pruned: %v", err)
+	}
+}
+
+func TestSyncedUnchanged(t *testing.T) {
+	date := time.Date(2018, 3, 2, 10, 20, 0, 0, uaLocation)
+	// synced 1,5 MB listed as 1572864 bytes
+	f := &syncedFile{Size: 1500000, Date: date, Listed: 1572864}
+	for _, tt := range []struct {
+		size int64
+		date time.Time
+		want bool
+	}{
+		{1572864, date, true},
+		// size not listed
+		{0, date, true},
+		{2097152, date, false},
+		{1572864, date.Add(time.Hour), false},
+	} {
+		it := &uaitem{size: tt.size, date: tt.date}
+		if got := f.unchanged(it); got != tt.want {
+			t.Errorf("size %d, date %s: got %v, want %v", tt.size, tt.date, got, tt.want)
+		}
+	}
+	// synced before sizes were recorded
+	old := &syncedFile{Size: 1500000, Date: date}
+	if !old.unchanged(&uaitem{size: 1572864, date: date}) {
+		t.Error("rounded size taken as a change")
+	}
+}
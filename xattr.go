@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// extended attributes are prefixed with xattrPrefix
+// ex: getfattr -d -m user.uafs <file>
+const xattrPrefix = "user.uafs."
+
+// xattrs returns UACloud metadata of item. Empty values are omitted.
+// nil if item is nil.
+func (root *FS) xattrs(it *uaitem) map[string]string {
+	if it == nil {
+		return nil
+	}
+	attrs := map[string]string{
+		"subject.code": it.codasig,
+		"subject.name": it.subject,
+		"title":        it.title,
+		"description":  it.desc,
+		"author":       it.author,
+		"content_type": root.facts.ctype(it.key()),
+	}
+	if it.cod != "-1" {
+		attrs["id"] = it.cod
+	}
+	if !it.date.IsZero() {
+		attrs["date"] = it.date.Format(time.RFC3339)
+	}
+	if !it.folder {
+		v := url.Values{}
+		v.Set("identificadores", it.cod)
+		v.Set("codasis", it.codasig)
+		attrs["url"] = endpoints.Download + "?" + v.Encode()
+	}
+	for k, v := range attrs {
+		if v == "" {
+			delete(attrs, k)
+		}
+	}
+	return attrs
+}
+
+// getxattr fills resp with the attribute of attrs requested in req
+func getxattr(attrs map[string]string, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if !strings.HasPrefix(req.Name, xattrPrefix) {
+		return fuse.ErrNoXattr
+	}
+	v, ok := attrs[strings.TrimPrefix(req.Name, xattrPrefix)]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	if req.Size != 0 && int(req.Size) < len(v) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	resp.Xattr = []byte(v)
+	return nil
+}
+
+// listxattr fills resp with all attribute names of attrs
+func listxattr(attrs map[string]string, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	for name := range attrs {
+		resp.Append(xattrPrefix + name)
+	}
+	if req.Size != 0 && int(req.Size) < len(resp.Xattr) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	return nil
+}
+
+var _ fs.NodeGetxattrer = (*Dir)(nil)
+
+// Getxattr returns UACloud metadata of the directory
+func (d *Dir) Getxattr(_ context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(d.Root.xattrs(d.item), req, resp)
+}
+
+var _ fs.NodeListxattrer = (*Dir)(nil)
+
+// Listxattr lists UACloud metadata attributes of the directory
+func (d *Dir) Listxattr(_ context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(d.Root.xattrs(d.item), req, resp)
+}
+
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+// Getxattr returns UACloud metadata of the file
+func (f *File) Getxattr(_ context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(f.Root.xattrs(f.item), req, resp)
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Listxattr lists UACloud metadata attributes of the file
+func (f *File) Listxattr(_ context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(f.Root.xattrs(f.item), req, resp)
+}
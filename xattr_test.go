@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/LibreLABUA/uafs/fakeua"
+	"golang.org/x/net/context"
+)
+
+// xattrNode is a node with extended attributes
+type xattrNode interface {
+	fs.NodeGetxattrer
+	fs.NodeListxattrer
+}
+
+func TestXattrs(t *testing.T) {
+	date := time.Date(2018, 3, 2, 10, 20, 0, 0, uaLocation)
+	startFake(t, &fakeua.Subject{
+		Code: "34012",
+		Name: "FUNDAMENTOS DE LOS COMPUTADORES",
+		Items: []*fakeua.Item{
+			{ID: "1001", Name: "Tema 1.pdf", Date: date, Author: "Pérez", Desc: "Transparencias", Content: []byte("tema 1")},
+			{ID: "1002", Name: "Prácticas", Folder: true},
+		},
+	})
+	root := testFS(t)
+	if err := root.fetch(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name  string
+		dir   bool
+		attrs map[string]string
+	}{{
+		name: "/FUNDAMENTOS DE LOS COMPUTADORES/Tema 1.pdf",
+		attrs: map[string]string{
+			"id":           "1001",
+			"subject.code": "34012",
+			"subject.name": "FUNDAMENTOS DE LOS COMPUTADORES",
+			"title":        "Tema 1.pdf",
+			"author":       "Pérez",
+			"description":  "Transparencias",
+			"date":         "2018-03-02T10:20:00+01:00",
+			"url":          endpoints.Download + "?codasis=34012&identificadores=1001",
+		},
+	}, {
+		name: "/FUNDAMENTOS DE LOS COMPUTADORES/Prácticas",
+		dir:  true,
+		attrs: map[string]string{
+			"id":           "1002",
+			"subject.code": "34012",
+			"subject.name": "FUNDAMENTOS DE LOS COMPUTADORES",
+			"title":        "Prácticas",
+		},
+	}, {
+		name: "/FUNDAMENTOS DE LOS COMPUTADORES",
+		dir:  true,
+		attrs: map[string]string{
+			"subject.code": "34012",
+			"subject.name": "FUNDAMENTOS DE LOS COMPUTADORES",
+			"title":        "FUNDAMENTOS DE LOS COMPUTADORES",
+		},
+	}} {
+		n := root.node(tt.name, tt.dir).(xattrNode)
+
+		var list fuse.ListxattrResponse
+		if err := n.Listxattr(ctx, &fuse.ListxattrRequest{}, &list); err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Split(strings.TrimSuffix(string(list.Xattr), "\x00"), "\x00")
+		var want []string
+		for k := range tt.attrs {
+			want = append(want, xattrPrefix+k)
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: listed %q, want %q", tt.name, got, want)
+		}
+		// too small buffer
+		err := n.Listxattr(ctx, &fuse.ListxattrRequest{Size: 1}, &fuse.ListxattrResponse{})
+		if err != fuse.Errno(syscall.ERANGE) {
+			t.Errorf("%s: listing to a small buffer: got %v, want ERANGE", tt.name, err)
+		}
+
+		for k, v := range tt.attrs {
+			var resp fuse.GetxattrResponse
+			err := n.Getxattr(ctx, &fuse.GetxattrRequest{Name: xattrPrefix + k}, &resp)
+			if err != nil || string(resp.Xattr) != v {
+				t.Errorf("%s: %s is %q (%v), want %q", tt.name, k, resp.Xattr, err, v)
+			}
+			err = n.Getxattr(ctx, &fuse.GetxattrRequest{Name: xattrPrefix + k, Size: 1}, &resp)
+			if err != fuse.Errno(syscall.ERANGE) {
+				t.Errorf("%s: %s to a small buffer: got %v, want ERANGE", tt.name, k, err)
+			}
+		}
+		for _, name := range []string{xattrPrefix + "unknown", "user.other", "security.selinux"} {
+			err := n.Getxattr(ctx, &fuse.GetxattrRequest{Name: name}, &fuse.GetxattrResponse{})
+			if err != fuse.ErrNoXattr {
+				t.Errorf("%s: %s: got %v, want ENODATA", tt.name, name, err)
+			}
+		}
+	}
+}